@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HaukeBartsch/redcapfs/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// collectionsDir holds the directories of workgroup collections, a directory created in it
+// gets a file for every instrument and field of the collection with the same name
+const collectionsDir = "collections"
+
+// collection lists the instruments and fields that belong to a workgroup
+type collection struct {
+	Instruments []string `yaml:"instruments"`
+	Fields      []string `yaml:"fields"`
+}
+
+// loadCollections reads the collections of a YAML file that maps the name of a collection to
+// its instruments and fields:
+//
+//	neurocog:
+//	  instruments: [screener, demographics]
+//	  fields: [scrn_age]
+//
+// A missing file has no collections.
+func loadCollections(path string) (map[string]collection, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c map[string]collection
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid collections %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// collections returns the collections of the session, the file is read every time so that
+// changes are used without a restart
+func (s *Session) collections() map[string]collection {
+	if s.collectionsFile == "" {
+		return nil
+	}
+	c, err := loadCollections(s.collectionsFile)
+	if err != nil {
+		fmt.Println("Error: could not read the collections", err)
+	}
+	return c
+}
+
+// collectionDir returns the collection of a directory in collections/ named after it, the name
+// can end with the extension of a file format
+func (s *Session) collectionDir(path string) (c collection, ext string, ok bool) {
+	dir, name := filepath.Split(path)
+	if filepath.Base(dir) != collectionsDir {
+		return c, "", false
+	}
+	ext = filepath.Ext(name)
+	if _, known := utils.WriterFor(ext); !known {
+		ext = ""
+	}
+	c, ok = s.collections()[strings.TrimSuffix(name, ext)]
+	return c, ext, ok
+}
+
+// addCollectionFiles adds a file for every instrument and field of the collection in the
+// directory at path. The files are in the format of the directory suffix (neurocog.csv) or in
+// the default format.
+func (s *Session) addCollectionFiles(path string) {
+	c, ext, ok := s.collectionDir(path)
+	if !ok {
+		if filepath.Base(filepath.Dir(path)) == collectionsDir {
+			fmt.Println("Error: no collection", filepath.Base(path), "in", s.collectionsFile)
+		}
+		return
+	}
+	if ext == "" {
+		ext = defaultFormat
+	}
+	for _, name := range append(c.Instruments, c.Fields...) {
+		s.addFile(path + "/" + name + ext)
+	}
+}
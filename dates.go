@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now is the time last-<n><unit> directories are counted back from
+var now = time.Now
+
+// dateRange selects the dates from (inclusive) up to to (exclusive), a zero from or to leaves
+// that side open
+type dateRange struct {
+	from, to time.Time
+}
+
+func (r dateRange) contains(t time.Time) bool {
+	return (r.from.IsZero() || !t.Before(r.from)) && (r.to.IsZero() || t.Before(r.to))
+}
+
+// parseDateRange reads the name of a date directory:
+//
+//	2019-06                 collected up to the end of June 2019
+//	2019-06-15              collected up to the end of that day
+//	until-2019-06-30        the same, with a month or a day
+//	2019-01..2019-06        collected from the start of January to the end of June 2019
+//	last-90d                collected in the last 90 days (also w, m and y)
+//	Jun 2019                collected up to the end of June 2019
+func parseDateRange(name string) (dateRange, bool) {
+	if i := strings.Index(name, ".."); i > 0 {
+		from, _, ok1 := parsePeriod(name[:i])
+		_, to, ok2 := parsePeriod(name[i+2:])
+		return dateRange{from: from, to: to}, ok1 && ok2 && from.Before(to)
+	}
+	if strings.HasPrefix(name, "last-") && len(name) > len("last-")+1 {
+		n, err := strconv.Atoi(name[len("last-") : len(name)-1])
+		if err != nil || n <= 0 {
+			return dateRange{}, false
+		}
+		t := now()
+		today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		var from time.Time
+		switch name[len(name)-1] {
+		case 'd':
+			from = today.AddDate(0, 0, -n)
+		case 'w':
+			from = today.AddDate(0, 0, -7*n)
+		case 'm':
+			from = today.AddDate(0, -n, 0)
+		case 'y':
+			from = today.AddDate(-n, 0, 0)
+		default:
+			return dateRange{}, false
+		}
+		return dateRange{from: from}, true
+	}
+	_, to, ok := parsePeriod(strings.TrimPrefix(name, "until-"))
+	return dateRange{to: to}, ok
+}
+
+// parsePeriod returns the start and the end of a month (2019-06) or a day (2019-06-15)
+func parsePeriod(s string) (start, end time.Time, ok bool) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, t.AddDate(0, 0, 1), true
+	}
+	for _, layout := range []string{"2006-01", "Jan 2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, t.AddDate(0, 1, 0), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// dateRanges returns the ranges of the date directories in path
+func dateRanges(path string) []dateRange {
+	var ranges []dateRange
+	dirs := strings.Split(path, "/")
+	for _, d := range dirs[:len(dirs)-1] {
+		if r, ok := parseDateRange(d); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// parseDate reads the value of a REDCap date or datetime field
+func parseDate(v string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/HaukeBartsch/redcapfs/redcap"
+)
+
+// joinSeparator separates the instruments and fields of a joined export, screener+demographics.csv
+const joinSeparator = "+"
+
+// joinedNames returns the instruments and fields of a joined export like screener+demographics,
+// ok is false unless there are at least two names and all of them are in the data dictionary
+func joinedNames(variable string, dict []map[string]string) (forms, fields []string, ok bool) {
+	names := strings.Split(variable, joinSeparator)
+	if len(names) < 2 {
+		return nil, nil, false
+	}
+	for _, name := range names {
+		kind := ""
+		for _, entry := range dict {
+			if entry["form_name"] == name {
+				kind = "form"
+				break
+			}
+			if entry["field_name"] == name {
+				kind = "field"
+				break
+			}
+		}
+		switch kind {
+		case "form":
+			forms = append(forms, name)
+		case "field":
+			fields = append(fields, name)
+		default:
+			return nil, nil, false
+		}
+	}
+	return forms, fields, true
+}
+
+// joiner merges the rows of a joined export that belong to the same record and event. REDCap
+// returns the rows of a record together, so only rows that follow each other are merged. Rows of
+// repeating instruments are kept apart. Field names are unique in a project, a field that is
+// joined more than once (screener+scrn_age) is a single column.
+type joiner struct {
+	id   string
+	emit func(map[string]string) error
+
+	key string
+	row map[string]string
+}
+
+// keyOf returns what identifies the row of a record in the output
+func (j *joiner) keyOf(entry map[string]string) string {
+	return strings.Join([]string{entry[j.id], entry["redcap_event_name"],
+		entry["redcap_repeat_instrument"], entry["redcap_repeat_instance"]}, "\x00")
+}
+
+// add merges entry into the current row, the current row is written first if entry belongs to
+// another record or event. Empty values do not replace values of earlier rows.
+func (j *joiner) add(entry map[string]string) error {
+	if k := j.keyOf(entry); j.row == nil || k != j.key {
+		if err := j.flush(); err != nil {
+			return err
+		}
+		j.key = k
+		j.row = make(map[string]string, len(entry))
+	}
+	for c, v := range entry {
+		if j.row[c] == "" {
+			j.row[c] = v
+		}
+	}
+	return nil
+}
+
+// flush writes the current row
+func (j *joiner) flush() error {
+	if j.row == nil {
+		return nil
+	}
+	row := j.row
+	j.row = nil
+	return j.emit(row)
+}
+
+// streamJoined calls fn for every merged row of a joined export, the instruments and fields are
+// exported with a single request
+func (s *Session) streamJoined(e redcap.Export, fn func(map[string]string) error) error {
+	id, err := s.client.RecordID()
+	if err != nil {
+		return err
+	}
+	j := &joiner{id: id, emit: fn}
+	if err := s.client.Stream(e, j.add); err != nil {
+		return err
+	}
+	return j.flush()
+}
@@ -15,11 +15,16 @@ import (
 )
 
 // NewMemNodeFSRoot creates an in-memory node-based filesystem. Files
-// are written into a backing store under the given prefix.
-func NewFSNodeFSRoot(prefix string, cb callback) Node {
+// are written into a backing store under the given prefix. The lister
+// provides read-only entries for directories that are looked into, the
+// exporter fills created and listed files when they are read and
+// decides which files can be created.
+func NewFSNodeFSRoot(prefix string, cb callback, ls lister, export exporter) Node {
 	fs := &memNodeFs{
 		backingStorePrefix: prefix,
 		cb:                 cb,
+		ls:                 ls,
+		export:             export,
 	}
 	fs.root = fs.newNode()
 	return fs.root
@@ -27,13 +32,23 @@ func NewFSNodeFSRoot(prefix string, cb callback) Node {
 
 type callback func(string, string)
 
+// lister returns the synthetic entries of the directory at the given
+// path. It is asked only once per directory, the first time the
+// directory is read or searched. Entries are read-only unless their mode
+// allows the owner to write, files can be created in such directories.
+type lister func(string) []fuse.DirEntry
+
 type memNodeFs struct {
 	backingStorePrefix string
 	root               *memNode
 	cb                 callback
+	ls                 lister
+	export             exporter
 
 	mutex    sync.Mutex
 	nextFree int
+	// conn is set once the file system is mounted
+	conn *FileSystemConnector
 }
 
 func (fs *memNodeFs) String() string {
@@ -47,10 +62,23 @@ func (fs *memNodeFs) Root() Node {
 func (fs *memNodeFs) SetDebug(bool) {
 }
 
-func (fs *memNodeFs) OnMount(*FileSystemConnector) {
+func (fs *memNodeFs) OnMount(conn *FileSystemConnector) {
+	fs.mutex.Lock()
+	fs.conn = conn
+	fs.mutex.Unlock()
+}
+
+// connector returns the connector of the mounted file system, or nil
+func (fs *memNodeFs) connector() *FileSystemConnector {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.conn
 }
 
 func (fs *memNodeFs) OnUnmount() {
+	fs.mutex.Lock()
+	fs.conn = nil
+	fs.mutex.Unlock()
 }
 
 func (fs *memNodeFs) newNode() *memNode {
@@ -83,6 +111,170 @@ type memNode struct {
 
 	link string
 	info fuse.Attr
+
+	// readOnly nodes are provided by the lister and cannot be changed
+	readOnly bool
+
+	// listMu protects listed, it is held while the lister runs
+	listMu sync.Mutex
+	// listed is set once the lister was asked for this directory
+	listed bool
+
+	// mu protects info, content and status
+	mu sync.Mutex
+	// content is set for files filled by the exporter
+	content *content
+	// status is reported for plain files by their status file
+	status *content
+}
+
+// path returns the location of the node relative to the mount point
+func (n *memNode) path() string {
+	pa, nam := n.Inode().Parent()
+	path := ""
+	for nam != "" {
+		if path == "" {
+			path = nam
+		} else {
+			path = nam + "/" + path
+		}
+		pa, nam = pa.Parent()
+	}
+	return path
+}
+
+// OnMount is called on the root node, we need the connector to tell
+// the kernel about files that change in the background
+func (n *memNode) OnMount(conn *FileSystemConnector) {
+	n.fs.OnMount(conn)
+}
+
+func (n *memNode) OnUnmount() {
+	n.fs.OnUnmount()
+}
+
+// childPath returns the location of the entry name in this directory
+func (n *memNode) childPath(name string) string {
+	if p := n.path(); p != "" {
+		return p + "/" + name
+	}
+	return name
+}
+
+// writable refuses changes to read-only directories and their entries
+func (n *memNode) writable(name string) fuse.Status {
+	if n.readOnly {
+		return fuse.EPERM
+	}
+	if ch := n.Inode().GetChild(name); ch != nil {
+		if mn, ok := ch.Node().(*memNode); ok && mn.readOnly {
+			return fuse.EPERM
+		}
+		if _, ok := ch.Node().(*statusNode); ok {
+			return fuse.EPERM
+		}
+	}
+	return fuse.OK
+}
+
+// populate adds the entries provided by the lister to this directory
+func (n *memNode) populate() {
+	// the lister can wait for a long time, attributes are served meanwhile
+	n.listMu.Lock()
+	defer n.listMu.Unlock()
+	if n.listed || n.fs.ls == nil {
+		return
+	}
+	n.listed = true
+
+	for _, e := range n.fs.ls(n.path()) {
+		if n.Inode().GetChild(e.Name) != nil {
+			continue
+		}
+		ch := n.fs.newNode()
+		isDir := e.Mode&fuse.S_IFDIR != 0
+		switch {
+		case isDir && e.Mode&0200 != 0:
+			ch.info.Mode = fuse.S_IFDIR | 0755
+		case isDir:
+			ch.readOnly = true
+			ch.info.Mode = fuse.S_IFDIR | 0555
+		default:
+			ch.readOnly = true
+			ch.info.Mode = fuse.S_IFREG | 0444
+		}
+		n.Inode().NewChild(e.Name, isDir, ch)
+	}
+}
+
+// Relist asks the lister again for every directory it filled. Entries
+// that are no longer listed are removed, new entries show up the next
+// time the directory is read or searched. Listed files whose export is
+// done are exported again the next time they are opened.
+func Relist(root Node) {
+	if n, ok := root.(*memNode); ok {
+		n.relist()
+	}
+}
+
+func (n *memNode) relist() {
+	n.listMu.Lock()
+	if n.listed {
+		n.listed = false
+		keep := make(map[string]bool)
+		for _, e := range n.fs.ls(n.path()) {
+			keep[e.Name] = true
+		}
+		for name, ch := range n.Inode().Children() {
+			mn, ok := ch.Node().(*memNode)
+			if !ok || !mn.readOnly {
+				continue
+			}
+			if !keep[name] {
+				n.Inode().RmChild(name)
+				if conn := n.fs.connector(); conn != nil {
+					go conn.EntryNotify(n.Inode(), name)
+				}
+			} else if !ch.IsDir() {
+				mn.reexport()
+			}
+		}
+	}
+	n.listMu.Unlock()
+
+	for _, ch := range n.Inode().Children() {
+		if mn, ok := ch.Node().(*memNode); ok && ch.IsDir() {
+			mn.relist()
+		}
+	}
+}
+
+func (n *memNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*Inode, fuse.Status) {
+	n.populate()
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		ch = n.statusFile(name)
+	}
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+func (n *memNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.populate()
+	entries, code := n.Node.OpenDir(context)
+	// status files are not listed
+	listed := entries[:0]
+	for _, e := range entries {
+		if ch := n.Inode().GetChild(e.Name); ch != nil {
+			if _, ok := ch.Node().(*statusNode); ok {
+				continue
+			}
+		}
+		listed = append(listed, e)
+	}
+	return listed, code
 }
 
 func (n *memNode) filename() string {
@@ -102,31 +294,24 @@ func (n *memNode) StatFs() *fuse.StatfsOut {
 }
 
 func (n *memNode) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *Inode, code fuse.Status) {
+	if code := n.writable(name); !code.Ok() {
+		return nil, code
+	}
 	ch := n.fs.newNode()
 	ch.info.Mode = mode | fuse.S_IFDIR
 	n.Inode().NewChild(name, true, ch)
 	nin := ch.Inode()
 
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
-	}
-	n.cb(path, "MKDIR")
+	n.cb(n.childPath(name), "MKDIR")
 
 	return nin, fuse.OK
 }
 
 func (n *memNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(name); !code.Ok() {
+		return code
 	}
-	n.cb(path, "UNLINK")
+	n.cb(n.childPath(name), "UNLINK")
 
 	ch := n.Inode().RmChild(name)
 	if ch == nil {
@@ -136,25 +321,19 @@ func (n *memNode) Unlink(name string, context *fuse.Context) (code fuse.Status)
 }
 
 func (n *memNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(name); !code.Ok() {
+		return code
 	}
-	n.cb(path, "RMDIR")
+	n.cb(n.childPath(name), "RMDIR")
 
 	return n.Unlink(name, context)
 }
 
 func (n *memNode) Symlink(name string, content string, context *fuse.Context) (newNode *Inode, code fuse.Status) {
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(name); !code.Ok() {
+		return nil, code
 	}
-	n.cb(path, "SYMLINK")
+	n.cb(n.childPath(name), "SYMLINK")
 
 	ch := n.fs.newNode()
 	ch.info.Mode = fuse.S_IFLNK | 0777
@@ -164,45 +343,70 @@ func (n *memNode) Symlink(name string, content string, context *fuse.Context) (n
 }
 
 func (n *memNode) Rename(oldName string, newParent Node, newName string, context *fuse.Context) (code fuse.Status) {
-	pa, nam := n.Inode().Parent()
-	path := newName
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(oldName); !code.Ok() {
+		return code
+	}
+	if mn, ok := newParent.(*memNode); ok {
+		if code := mn.writable(newName); !code.Ok() {
+			return code
+		}
 	}
-	n.cb(path, "RENAME")
 
 	ch := n.Inode().RmChild(oldName)
 	newParent.Inode().RmChild(newName)
 	newParent.Inode().AddChild(newName, ch)
+	// the file is at its new place when we tell about it
+	if mn, ok := newParent.(*memNode); ok {
+		n.cb(mn.childPath(newName), "RENAME")
+	}
+
+	// a file renamed to the name of an export is filled like a created one
+	mn, ok := ch.Node().(*memNode)
+	if ok && !ch.IsDir() && mn.exported() == nil && n.fs.export != nil {
+		if p, _ := n.fs.export(mn.path()); p != nil {
+			mn.mu.Lock()
+			mn.content = newContent(p)
+			mn.mu.Unlock()
+			mn.startExport()
+		}
+	}
 	return fuse.OK
 }
 
 func (n *memNode) Link(name string, existing Node, context *fuse.Context) (*Inode, fuse.Status) {
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(name); !code.Ok() {
+		return nil, code
 	}
-	n.cb(path, "LINK")
+	n.cb(n.childPath(name), "LINK")
 
 	n.Inode().AddChild(name, existing.Inode())
 	return existing.Inode(), fuse.OK
 }
 
 func (n *memNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file File, node *Inode, code fuse.Status) {
-	pa, nam := n.Inode().Parent()
-	path := name
-	for nam != "" {
-		path = nam + "/" + path
-		pa, nam = pa.Parent()
+	if code := n.writable(name); !code.Ok() {
+		return nil, nil, code
+	}
+	path := n.childPath(name)
+	var p Producer
+	if n.fs.export != nil {
+		if p, code = n.fs.export(path); !code.Ok() {
+			return nil, nil, code
+		}
 	}
 	n.cb(path, "CREATE")
 
 	ch := n.fs.newNode()
 	ch.info.Mode = mode | fuse.S_IFREG
 
+	if p != nil {
+		ch.content = newContent(p)
+		n.Inode().NewChild(name, false, ch)
+		ch.startExport()
+		f, code := ch.openExport(0)
+		return f, ch.Inode(), code
+	}
+
 	f, err := os.Create(ch.filename())
 	if err != nil {
 		return nil, nil, fuse.ToStatus(err)
@@ -214,6 +418,10 @@ func (n *memNode) Create(name string, flags uint32, mode uint32, context *fuse.C
 type memNodeFile struct {
 	File
 	node *memNode
+
+	// written is set by Write until the next Flush
+	mu      sync.Mutex
+	written bool
 }
 
 func (n *memNodeFile) String() string {
@@ -224,6 +432,18 @@ func (n *memNodeFile) InnerFile() File {
 	return n.File
 }
 
+func (n *memNodeFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	written, code := n.File.Write(data, off)
+	if code.Ok() {
+		n.mu.Lock()
+		n.written = true
+		n.mu.Unlock()
+	}
+	return written, code
+}
+
+// Flush updates the size of the node, files that were written to are
+// reported as WRITE once they are complete
 func (n *memNodeFile) Flush() fuse.Status {
 	code := n.File.Flush()
 
@@ -233,8 +453,18 @@ func (n *memNodeFile) Flush() fuse.Status {
 
 	st := syscall.Stat_t{}
 	err := syscall.Stat(n.node.filename(), &st)
+	n.node.mu.Lock()
 	n.node.info.Size = uint64(st.Size)
 	n.node.info.Blocks = uint64(st.Blocks)
+	n.node.mu.Unlock()
+
+	n.mu.Lock()
+	written := n.written
+	n.written = false
+	n.mu.Unlock()
+	if written && err == nil {
+		n.node.cb(n.node.path(), "WRITE")
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -246,6 +476,9 @@ func (n *memNode) newFile(f *os.File) File {
 }
 
 func (n *memNode) Open(flags uint32, context *fuse.Context) (file File, code fuse.Status) {
+	if c := n.exported(); c != nil {
+		return n.openExport(flags)
+	}
 	f, err := os.OpenFile(n.filename(), int(flags), 0666)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -255,11 +488,16 @@ func (n *memNode) Open(flags uint32, context *fuse.Context) (file File, code fus
 }
 
 func (n *memNode) GetAttr(fi *fuse.Attr, file File, context *fuse.Context) (code fuse.Status) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	*fi = n.info
 	return fuse.OK
 }
 
 func (n *memNode) Truncate(file File, size uint64, context *fuse.Context) (code fuse.Status) {
+	if n.readOnly || n.exported() != nil {
+		return fuse.EPERM
+	}
 	if file != nil {
 		code = file.Truncate(size)
 	} else {
@@ -268,30 +506,48 @@ func (n *memNode) Truncate(file File, size uint64, context *fuse.Context) (code
 	}
 	if code.Ok() {
 		now := time.Now()
+		n.mu.Lock()
 		n.info.SetTimes(nil, nil, &now)
 		// TODO - should update mtime too?
 		n.info.Size = size
+		n.mu.Unlock()
 	}
 	return code
 }
 
 func (n *memNode) Utimens(file File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	if n.readOnly {
+		return fuse.EPERM
+	}
 	c := time.Now()
+	n.mu.Lock()
 	n.info.SetTimes(atime, mtime, &c)
+	n.mu.Unlock()
+	n.cb(n.path(), "UTIMENS")
 	return fuse.OK
 }
 
 func (n *memNode) Chmod(file File, perms uint32, context *fuse.Context) (code fuse.Status) {
-	n.info.Mode = (n.info.Mode &^ 07777) | perms
+	if n.readOnly {
+		return fuse.EPERM
+	}
 	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.info.Mode = (n.info.Mode &^ 07777) | perms
 	n.info.SetTimes(nil, nil, &now)
 	return fuse.OK
 }
 
 func (n *memNode) Chown(file File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if n.readOnly {
+		return fuse.EPERM
+	}
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.info.Uid = uid
 	n.info.Gid = gid
-	now := time.Now()
 	n.info.SetTimes(nil, nil, &now)
 	return fuse.OK
 }
@@ -0,0 +1,347 @@
+package nodefsC
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Producer writes the content of a file and returns the number of
+// records it wrote.
+type Producer func(w io.Writer) (int, error)
+
+// exporter returns the producer for the file at the given path. A nil
+// producer with fuse.OK is returned for plain files the file system does
+// not fill, an error status refuses to create the file.
+type exporter func(string) (Producer, fuse.Status)
+
+// content is produced once in the background, readers wait for it
+type content struct {
+	produce Producer
+	start   sync.Once
+	done    chan struct{}
+
+	// mu protects the fields below, they are reported by the status
+	mu      sync.Mutex
+	state   string
+	written int64
+	records int
+	err     error
+}
+
+func newContent(p Producer) *content {
+	return &content{
+		produce: p,
+		done:    make(chan struct{}),
+		state:   StateQueued,
+	}
+}
+
+// Write counts the bytes written by the producer
+func (c *content) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written += int64(len(b))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+// finish records the outcome of the export
+func (c *content) finish(records int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records, c.err = records, err
+	if err != nil {
+		c.state = StateFailed
+	} else {
+		c.state = StateDone
+	}
+}
+
+// NewFile adds a file at path below the root of the file system. The
+// content of the file is produced right away and served once it is
+// complete. An existing file with the same name is replaced.
+func NewFile(root Node, path string, p Producer) fuse.Status {
+	n, name, code := lookupDir(root, path)
+	if !code.Ok() {
+		return code
+	}
+	n.Inode().RmChild(name)
+
+	ch := n.fs.newNode()
+	ch.info.Mode = fuse.S_IFREG | 0644
+	ch.content = newContent(p)
+	n.Inode().NewChild(name, false, ch)
+	// the kernel might still know the replaced file, or that there was
+	// none. We can be called while a request on the directory is
+	// served, so do not wait for the kernel here.
+	if conn := n.fs.connector(); conn != nil {
+		go conn.EntryNotify(n.Inode(), name)
+	}
+	ch.startExport()
+	return fuse.OK
+}
+
+// ReadFile returns the content of the file at path that was written
+// into the file system. Exported files are not read.
+func ReadFile(root Node, path string) ([]byte, fuse.Status) {
+	n, name, code := lookupDir(root, path)
+	if !code.Ok() {
+		return nil, code
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+	mn, ok := ch.Node().(*memNode)
+	if !ok || ch.IsDir() || mn.exported() != nil {
+		return nil, fuse.EINVAL
+	}
+	data, err := ioutil.ReadFile(mn.filename())
+	return data, fuse.ToStatus(err)
+}
+
+// SetStatus reports err as the failure of the plain file at path in its
+// status file, the status is removed if err is nil
+func SetStatus(root Node, path string, err error) fuse.Status {
+	n, name, code := lookupDir(root, path)
+	if !code.Ok() {
+		return code
+	}
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return fuse.ENOENT
+	}
+	mn, ok := ch.Node().(*memNode)
+	if !ok || ch.IsDir() || mn.exported() != nil {
+		return fuse.EINVAL
+	}
+	var c *content
+	if err != nil {
+		c = newContent(nil)
+		c.finish(0, err)
+	}
+	mn.mu.Lock()
+	mn.status = c
+	mn.mu.Unlock()
+	return fuse.OK
+}
+
+// Remove removes the file at path from the file system
+func Remove(root Node, path string) fuse.Status {
+	n, name, code := lookupDir(root, path)
+	if !code.Ok() {
+		return code
+	}
+	if n.Inode().RmChild(name) == nil {
+		return fuse.ENOENT
+	}
+	if conn := n.fs.connector(); conn != nil {
+		go conn.EntryNotify(n.Inode(), name)
+	}
+	return fuse.OK
+}
+
+// lookupDir returns the directory of path and the name of the entry in it
+func lookupDir(root Node, path string) (*memNode, string, fuse.Status) {
+	n, ok := root.(*memNode)
+	if !ok {
+		return nil, "", fuse.EINVAL
+	}
+	l := strings.Split(strings.Trim(path, "/"), "/")
+	for _, d := range l[:len(l)-1] {
+		ch := n.Inode().GetChild(d)
+		if ch == nil {
+			return nil, "", fuse.ENOENT
+		}
+		if n, ok = ch.Node().(*memNode); !ok {
+			return nil, "", fuse.EINVAL
+		}
+	}
+	return n, l[len(l)-1], fuse.OK
+}
+
+// exported returns the content of the node, listed files ask the
+// exporter the first time
+func (n *memNode) exported() *content {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.content == nil && n.readOnly && n.fs.export != nil && !n.Inode().IsDir() {
+		if p, _ := n.fs.export(n.path()); p != nil {
+			n.content = newContent(p)
+		}
+	}
+	return n.content
+}
+
+// reexport drops the content of a listed file once its export is done,
+// the exporter is asked again the next time the file is opened
+func (n *memNode) reexport() {
+	n.mu.Lock()
+	c := n.content
+	if !n.readOnly || c == nil {
+		n.mu.Unlock()
+		return
+	}
+	select {
+	case <-c.done:
+		n.content = nil
+	default:
+		// a running export is kept
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+	if conn := n.fs.connector(); conn != nil {
+		go conn.FileNotify(n.Inode(), 0, 0)
+	}
+}
+
+// startExport runs the producer of the node once in the background
+func (n *memNode) startExport() {
+	c := n.exported()
+	if c == nil {
+		return
+	}
+	c.start.Do(func() {
+		go n.export(c)
+	})
+}
+
+// waitExport starts the export if needed and blocks until it is done
+func (n *memNode) waitExport() error {
+	n.startExport()
+	c := n.exported()
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	_, _, _, err := c.status()
+	return err
+}
+
+func (n *memNode) export(c *content) {
+	c.mu.Lock()
+	c.state = StateRunning
+	c.mu.Unlock()
+
+	f, err := os.Create(n.filename())
+	if err != nil {
+		c.finish(0, err)
+		close(c.done)
+		return
+	}
+	records, err := c.produce(io.MultiWriter(f, c))
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("export of %s failed: %v", n.path(), err)
+	}
+	c.finish(records, err)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(n.filename(), &st); err == nil {
+		n.mu.Lock()
+		n.info.Size = uint64(st.Size)
+		n.info.Blocks = uint64(st.Blocks)
+		now := time.Now()
+		n.info.SetTimes(nil, &now, &now)
+		n.mu.Unlock()
+	}
+	close(c.done)
+
+	// readers are released first, invalidating the cache waits for
+	// pending reads of the file
+	if conn := n.fs.connector(); conn != nil {
+		conn.FileNotify(n.Inode(), 0, 0)
+		if pa, name := n.Inode().Parent(); pa != nil {
+			if st := pa.GetChild(name + StatusSuffix); st != nil {
+				conn.FileNotify(st, -1, 0)
+			}
+		}
+	}
+}
+
+// openExport returns a read-only file for an exported node, reads
+// block until the export is done
+func (n *memNode) openExport(flags uint32) (File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	return &WithFlags{
+		File: &exportedFile{
+			File: NewDefaultFile(),
+			node: n,
+		},
+		// the size of the file is not known before the export is done
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+// exportedFile serves the content of a node once its export finished
+type exportedFile struct {
+	File
+	node *memNode
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (f *exportedFile) String() string {
+	return fmt.Sprintf("exportedFile(%s)", f.node.filename())
+}
+
+func (f *exportedFile) open() (*os.File, fuse.Status) {
+	// the reason is in the status of the file
+	if err := f.node.waitExport(); err != nil {
+		return nil, fuse.EIO
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		fd, err := os.Open(f.node.filename())
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		f.f = fd
+	}
+	return f.f, fuse.OK
+}
+
+func (f *exportedFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	fd, code := f.open()
+	if !code.Ok() {
+		return nil, code
+	}
+	n, err := fd.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return fuse.ReadResultData(buf[:n]), fuse.ToStatus(err)
+}
+
+func (f *exportedFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return 0, fuse.EPERM
+}
+
+func (f *exportedFile) Flush() fuse.Status {
+	return fuse.OK
+}
+
+func (f *exportedFile) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+}
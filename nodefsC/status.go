@@ -0,0 +1,155 @@
+package nodefsC
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// States of an export as reported by the status file and the
+// user.redcapfs.state extended attribute.
+const (
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// StatusSuffix is appended to the name of an exported file to read its
+// status. Status files can be looked up but are not listed.
+const StatusSuffix = ".status"
+
+// extended attributes of exported files
+const (
+	xattrState   = "user.redcapfs.state"
+	xattrRecords = "user.redcapfs.records"
+	xattrError   = "user.redcapfs.error"
+)
+
+// status returns the state of the export, the number of bytes written
+// so far, the number of records and the error of a failed export
+func (c *content) status() (state string, written int64, records int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state, c.written, c.records, c.err
+}
+
+// String formats the status as the content of the status file
+func (c *content) String() string {
+	state, written, records, err := c.status()
+	s := fmt.Sprintf("state: %s\nbytes: %d\n", state, written)
+	switch state {
+	case StateDone:
+		s += fmt.Sprintf("records: %d\n", records)
+	case StateFailed:
+		s += fmt.Sprintf("error: %v\n", err)
+	}
+	return s
+}
+
+// statusNode is the status file of the exported file name in dir
+type statusNode struct {
+	Node
+	dir  *memNode
+	name string
+}
+
+// statusFile returns the status file for name, if name is the status
+// file of an exported file in this directory
+func (n *memNode) statusFile(name string) *Inode {
+	target := strings.TrimSuffix(name, StatusSuffix)
+	if target == name || n.target(target) == nil {
+		return nil
+	}
+	return n.Inode().NewChild(name, false, &statusNode{
+		Node: NewDefaultNode(),
+		dir:  n,
+		name: target,
+	})
+}
+
+// target returns the content of the exported file name in this directory
+func (n *memNode) target(name string) *content {
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil
+	}
+	mn, ok := ch.Node().(*memNode)
+	if !ok || ch.IsDir() {
+		return nil
+	}
+	return mn.state()
+}
+
+// state returns the content of an exported file or the status set for a
+// plain file with SetStatus
+func (n *memNode) state() *content {
+	if c := n.exported(); c != nil {
+		return c
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.status
+}
+
+func (n *statusNode) GetAttr(out *fuse.Attr, file File, context *fuse.Context) fuse.Status {
+	c := n.dir.target(n.name)
+	if c == nil {
+		return fuse.ENOENT
+	}
+	n.dir.mu.Lock()
+	*out = n.dir.info
+	n.dir.mu.Unlock()
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(c.String()))
+	return fuse.OK
+}
+
+func (n *statusNode) Open(flags uint32, context *fuse.Context) (File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	c := n.dir.target(n.name)
+	if c == nil {
+		return nil, fuse.ENOENT
+	}
+	return &WithFlags{
+		File: NewDataFile([]byte(c.String())),
+		// the status changes while the export runs
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+func (n *memNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	c := n.state()
+	if c == nil {
+		return nil, fuse.ENOATTR
+	}
+	state, _, records, err := c.status()
+	switch {
+	case attribute == xattrState:
+		return []byte(state), fuse.OK
+	case attribute == xattrRecords && state == StateDone:
+		return []byte(strconv.Itoa(records)), fuse.OK
+	case attribute == xattrError && state == StateFailed:
+		return []byte(err.Error()), fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+func (n *memNode) ListXAttr(context *fuse.Context) ([]string, fuse.Status) {
+	c := n.state()
+	if c == nil {
+		return nil, fuse.OK
+	}
+	attrs := []string{xattrState}
+	switch state, _, _, _ := c.status(); state {
+	case StateDone:
+		attrs = append(attrs, xattrRecords)
+	case StateFailed:
+		attrs = append(attrs, xattrError)
+	}
+	return attrs, fuse.OK
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/HaukeBartsch/redcapfs/nodefsC"
+	"github.com/HaukeBartsch/redcapfs/redcap"
+	"github.com/HaukeBartsch/redcapfs/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// queryExt is the extension of query files, the result of myquery.rcq is written next to it
+// as myquery.<format>
+const queryExt = ".rcq"
+
+// query is the content of a query file:
+//
+//	fields: [scrn_age, demo_weight]
+//	events: [baseline_year_1_arm_1]
+//	filterLogic: "[scrn_age] > 9"
+//	format: csv
+//
+// Only fields is required, all events are exported if there are none and the format is the
+// default format if it is not set.
+type query struct {
+	Fields      []string `yaml:"fields"`
+	Events      []string `yaml:"events"`
+	FilterLogic string   `yaml:"filterLogic"`
+	Format      string   `yaml:"format"`
+}
+
+// parseQuery reads the content of a query file. The format of an invalid query is still
+// returned if it can be read, known is false if the result of the query has no format.
+func parseQuery(data []byte) (q query, known bool, err error) {
+	if err := yaml.UnmarshalStrict(data, &q); err != nil {
+		q = query{}
+		if yaml.Unmarshal(data, &q) != nil {
+			return q, false, err
+		}
+		_, known = utils.WriterFor(q.ext())
+		return q, known, err
+	}
+	if _, ok := utils.WriterFor(q.ext()); !ok {
+		return q, false, fmt.Errorf("unknown format %q, use one of %v", q.Format, utils.Extensions())
+	}
+	if len(q.Fields) == 0 {
+		return q, true, errors.New("no fields in the query")
+	}
+	return q, true, nil
+}
+
+// ext returns the extension of the result of the query
+func (q query) ext() string {
+	if q.Format == "" {
+		return defaultFormat
+	}
+	return "." + strings.TrimPrefix(q.Format, ".")
+}
+
+// queryExport returns the path of the result of the query file at path and how it is exported.
+// The directories of the query file filter the records like they do for all other exports.
+func (s *Session) queryExport(path string, q query) (string, nodefsC.Producer) {
+	out := strings.TrimSuffix(path, queryExt) + q.ext()
+	w, _ := utils.WriterFor(q.ext())
+	e := redcap.Export{
+		Fields: q.Fields,
+		Events: q.Events,
+		Filter: redcap.And(filterLogic(path), q.FilterLogic),
+	}
+	if event := s.eventOf(path); len(e.Events) == 0 && event != "" {
+		e.Events = []string{event}
+	}
+	return out, s.streamRecords(w, path, e, func(fn func(map[string]string) error) error {
+		return s.client.Stream(e, fn)
+	})
+}
+
+// runQuery writes the result of the query file at path next to it and removes the result of an
+// earlier version of the query in another format. A query that cannot be read gives a failed
+// result, the reason is in its status file. If not even the format can be read the status file
+// of the query has the reason.
+func (s *Session) runQuery(path string) {
+	s.queryMu.Lock()
+	defer s.queryMu.Unlock()
+
+	data, code := nodefsC.ReadFile(s.root, path)
+	if !code.Ok() {
+		fmt.Println("Error: could not read the query", path, code)
+		return
+	}
+	q, known, err := parseQuery(data)
+	if err != nil {
+		err = fmt.Errorf("invalid query %s: %v", path, err)
+		fmt.Println("Error:", err)
+	}
+	out := ""
+	if known {
+		out = strings.TrimSuffix(path, queryExt) + q.ext()
+	}
+	if old := s.queryResults[path]; old != "" && old != out {
+		nodefsC.Remove(s.root, old)
+	}
+	s.queryResults[path] = out
+
+	if out == "" {
+		nodefsC.SetStatus(s.root, path, err)
+		return
+	}
+	nodefsC.SetStatus(s.root, path, nil)
+	p := func(io.Writer) (int, error) {
+		return 0, err
+	}
+	if err == nil {
+		_, p = s.queryExport(path, q)
+	}
+	if code := nodefsC.NewFile(s.root, out, p); !code.Ok() {
+		fmt.Println("Error: could not add", out, code)
+	}
+}
@@ -0,0 +1,153 @@
+package redcap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache keeps REDCap responses on disk. Entries are addressed by a hash of
+// the API URL, the token and the request parameters and are used until the
+// TTL of their content type expires.
+type Cache struct {
+	// Dir holds the cached responses.
+	Dir string
+	// TTL maps content types (record, metadata, formEventMapping) to the
+	// time a response is used, the entry "" applies to all other types.
+	TTL map[string]time.Duration
+}
+
+// NewCache returns a cache in dir, the directory is created if needed
+func NewCache(dir string, ttl map[string]time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir, TTL: ttl}, nil
+}
+
+// ParseTTL reads the time to live of cached responses, either a single
+// duration for all content types like "10m" or a list of content types
+// and durations like "record=10m,metadata=24h".
+func ParseTTL(s string) (map[string]time.Duration, error) {
+	ttl := make(map[string]time.Duration)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		content := ""
+		if i := strings.Index(part, "="); i >= 0 {
+			content, part = part[:i], part[i+1:]
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("redcap: invalid cache ttl %q: %v", s, err)
+		}
+		ttl[content] = d
+	}
+	return ttl, nil
+}
+
+func (c *Cache) ttl(content string) time.Duration {
+	if d, ok := c.TTL[content]; ok {
+		return d
+	}
+	return c.TTL[""]
+}
+
+// key addresses the response of a request, the token is hashed on its own
+// so it cannot be recovered from the cache. The key starts with the content
+// type so that Expire can find the responses of a type.
+func (c *Cache) key(u string, token string, values url.Values) string {
+	v := url.Values{}
+	for k, vals := range values {
+		if k != "token" {
+			v[k] = vals
+		}
+	}
+	t := sha256.Sum256([]byte(token))
+	h := sha256.Sum256([]byte(u + "\n" + hex.EncodeToString(t[:]) + "\n" + v.Encode()))
+	return values.Get("content") + "-" + hex.EncodeToString(h[:])
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// open returns the cached response for key, or nil if there is none or it
+// expired
+func (c *Cache) open(key string, content string) *os.File {
+	fi, err := os.Stat(c.path(key))
+	if err != nil || time.Since(fi.ModTime()) > c.ttl(content) {
+		return nil
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// create returns a new entry for key, it is only visible after commit
+func (c *Cache) create(key string) (*cacheEntry, error) {
+	f, err := ioutil.TempFile(c.Dir, key+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheEntry{File: f, path: c.path(key)}, nil
+}
+
+// Invalidate removes all cached responses
+func (c *Cache) Invalidate() error {
+	l, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range l {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expire removes the cached responses of the given content types
+func (c *Cache) Expire(contents ...string) error {
+	for _, content := range contents {
+		l, err := filepath.Glob(filepath.Join(c.Dir, content+"-*.json"))
+		if err != nil {
+			return err
+		}
+		for _, p := range l {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cacheEntry is a response written to the cache
+type cacheEntry struct {
+	*os.File
+	path string
+}
+
+func (e *cacheEntry) commit() error {
+	if err := e.Close(); err != nil {
+		os.Remove(e.Name())
+		return err
+	}
+	return os.Rename(e.Name(), e.path)
+}
+
+func (e *cacheEntry) abort() {
+	e.Close()
+	os.Remove(e.Name())
+}
@@ -0,0 +1,129 @@
+package redcap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func setupCacheTest(t *testing.T, ttl time.Duration) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "redcap_cache")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	cache, err := NewCache(dir, map[string]time.Duration{"": ttl})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func TestCache(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+	cache, clean := setupCacheTest(t, time.Hour)
+	defer clean()
+	c.Cache = cache
+	c.BatchSize = 0
+
+	first, err := c.GetInstrument("screener")
+	if err != nil {
+		t.Fatalf("GetInstrument failed: %v", err)
+	}
+	n := len(srv.Requests())
+	second, err := c.GetInstrument("screener")
+	if err != nil || len(second) != len(first) {
+		t.Fatalf("got %d records from the cache (%v), want %d", len(second), err, len(first))
+	}
+	if len(srv.Requests()) != n {
+		t.Errorf("the cached response was not used")
+	}
+
+	// other parameters are not answered from the cache
+	if _, err := c.GetInstrument("demographics"); err != nil || len(srv.Requests()) != n+1 {
+		t.Errorf("demographics should be requested (%v)", err)
+	}
+
+	if err := cache.Invalidate(); err != nil {
+		t.Fatalf("Invalidate failed: %v", err)
+	}
+	c.GetInstrument("screener")
+	if len(srv.Requests()) != n+2 {
+		t.Errorf("screener should be requested again after Invalidate")
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+	cache, clean := setupCacheTest(t, 0)
+	defer clean()
+	cache.TTL["metadata"] = time.Hour
+	c.Cache = cache
+
+	c.GetInstruments()
+	c.GetFormEventMapping()
+	n := len(srv.Requests())
+	c.GetInstruments()
+	c.GetFormEventMapping()
+	// metadata is kept for an hour, the event mapping not at all
+	if got := len(srv.Requests()) - n; got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+	cache, clean := setupCacheTest(t, time.Hour)
+	defer clean()
+	c.Cache = cache
+	c.BatchSize = 0
+
+	c.GetInstruments()
+	c.GetInstrument("screener")
+	n := len(srv.Requests())
+	if err := cache.Expire("metadata"); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	c.GetInstruments()
+	c.GetInstrument("screener")
+	// only the data dictionary is asked for again
+	if got := len(srv.Requests()) - n; got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestCacheSkipsErrors(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+	cache, clean := setupCacheTest(t, time.Hour)
+	defer clean()
+	c.Cache = cache
+
+	c.Tokens = []string{"invalid"}
+	c.GetInstruments()
+	if _, err := c.GetInstruments(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v, failed requests should not be cached", err)
+	}
+	c.Tokens = []string{"other"}
+	if _, err := c.GetInstruments(); err == nil {
+		t.Errorf("responses for one token should not be used for another")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	ttl, err := ParseTTL("10m")
+	if err != nil || ttl[""] != 10*time.Minute {
+		t.Errorf("got %v (%v)", ttl, err)
+	}
+	ttl, err = ParseTTL("record=5m, metadata=24h")
+	if err != nil || ttl["record"] != 5*time.Minute || ttl["metadata"] != 24*time.Hour {
+		t.Errorf("got %v (%v)", ttl, err)
+	}
+	if _, err := ParseTTL("record=often"); err == nil {
+		t.Errorf("invalid durations should fail")
+	}
+}
@@ -0,0 +1,542 @@
+// Package redcap is a small client for the REDCap API.
+package redcap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.net/publicsuffix"
+)
+
+// ErrNoToken is returned if the client has no access token to talk to REDCap.
+var ErrNoToken = errors.New("redcap: no access token")
+
+// Client exports data from a REDCap server. A client can hold tokens for
+// more than one account, records are collected for all of them.
+type Client struct {
+	// URL of the REDCap API, e.g. https://abcd-rc.ucsd.edu/redcap/api/
+	URL string
+	// Tokens are the REDCap API tokens used for the export.
+	Tokens []string
+	// HTTP is shared by all requests of this client.
+	HTTP *http.Client
+	// BatchSize is the number of records asked for in a single record export,
+	// all records are exported at once if it is 0.
+	BatchSize int
+	// Parallel is the number of batches exported at the same time.
+	Parallel int
+	// Cache stores responses on disk if it is not nil.
+	Cache *Cache
+	// Profile selects the exported records.
+	Profile Profile
+
+	mu       sync.Mutex
+	recordID string
+}
+
+// NewClient returns a client for the REDCap API at url using the given tokens.
+func NewClient(url string, tokens []string) (*Client, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		URL:       url,
+		Tokens:    tokens,
+		HTTP:      &http.Client{Jar: jar, Transport: NewTransport()},
+		BatchSize: 500,
+		Parallel:  4,
+	}, nil
+}
+
+// stream sends a single API request for the given token and calls fn for every entry of the
+// returned list while the response is read, so only one entry is kept in memory at a time.
+// Responses are taken from and added to the cache of the client.
+func (c *Client) stream(token string, values url.Values, fn func(map[string]string) error) error {
+	values.Set("token", token)
+	values.Set("format", "json")
+	values.Set("returnFormat", "json")
+	key := ""
+	if c.Cache != nil {
+		key = c.Cache.key(c.URL, token, values)
+		if f := c.Cache.open(key, values.Get("content")); f != nil {
+			defer f.Close()
+			return decodeList(f, fn)
+		}
+	}
+	body := values.Encode()
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(body)))
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if resp.StatusCode != http.StatusOK || isObject(r) {
+		data, _ := ioutil.ReadAll(io.LimitReader(r, 4096))
+		return apiError(values.Get("content"), resp.StatusCode, data)
+	}
+	if c.Cache == nil {
+		return decodeList(r, fn)
+	}
+
+	// the cache is best effort, a response is still exported if it cannot be stored
+	e, err := c.Cache.create(key)
+	if err != nil {
+		return decodeList(r, fn)
+	}
+	if err := decodeList(io.TeeReader(r, e), fn); err != nil {
+		e.abort()
+		return err
+	}
+	e.commit()
+	return nil
+}
+
+// decodeList calls fn for every entry of the JSON list returned by REDCap
+func decodeList(r io.Reader, fn func(map[string]string) error) error {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	if t, err := d.Token(); err != nil || t != json.Delim('[') {
+		return fmt.Errorf("redcap: could not decode response: expected a list, got %v (%v)", t, err)
+	}
+	for d.More() {
+		var v map[string]interface{}
+		if err := d.Decode(&v); err != nil {
+			return fmt.Errorf("redcap: could not decode response: %v", err)
+		}
+		if err := fn(entry(v)); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Token(); err != nil {
+		return fmt.Errorf("redcap: could not decode response: %v", err)
+	}
+	return nil
+}
+
+// isObject returns true if the response is a single JSON object instead of a list, REDCap
+// reports errors this way
+func isObject(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '{'
+		}
+	}
+}
+
+// apiError returns the error REDCap reported in the body of a failed request
+func apiError(content string, status int, body []byte) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	message := string(bytes.TrimSpace(body))
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		message = e.Error
+	}
+	return &Error{
+		Content:    content,
+		StatusCode: status,
+		Message:    message,
+		Err:        cause(status, message),
+	}
+}
+
+// post sends a single API request for the given token and returns the decoded list of entries
+func (c *Client) post(token string, values url.Values) ([]map[string]string, error) {
+	ret := []map[string]string{}
+	err := c.stream(token, values, func(v map[string]string) error {
+		ret = append(ret, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// entry converts a decoded JSON object returned by REDCap into a string map, numbers
+// and booleans are kept in their textual form
+func entry(v map[string]interface{}) map[string]string {
+	ret := make(map[string]string, len(v))
+	for k, v2 := range v {
+		if v2 == nil {
+			ret[k] = ""
+			continue
+		}
+		ret[k] = fmt.Sprint(v2)
+	}
+	return ret
+}
+
+// firstToken returns the token used for requests that do not depend on the account
+func (c *Client) firstToken() (string, error) {
+	if len(c.Tokens) < 1 {
+		return "", ErrNoToken
+	}
+	return c.Tokens[0], nil
+}
+
+// RecordID returns the field that identifies a record, the one of the profile or the first
+// field of the data dictionary
+func (c *Client) RecordID() (string, error) {
+	if c.Profile.RecordID != "" {
+		return c.Profile.RecordID, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recordID != "" {
+		return c.recordID, nil
+	}
+	dict, err := c.GetInstruments()
+	if err != nil {
+		return "", err
+	}
+	if len(dict) == 0 || dict[0]["field_name"] == "" {
+		return "", errors.New("redcap: the data dictionary is empty")
+	}
+	c.recordID = dict[0]["field_name"]
+	return c.recordID, nil
+}
+
+// streamRecords asks REDCap for records using every token of the client and calls fn for
+// the records selected by the profile
+func (c *Client) streamRecords(values url.Values, fn func(map[string]string) error) error {
+	if len(c.Tokens) < 1 {
+		return ErrNoToken
+	}
+	id, err := c.RecordID()
+	if err != nil {
+		return err
+	}
+	for _, token := range c.Tokens {
+		v := url.Values{}
+		for k, vals := range values {
+			v[k] = vals
+		}
+		addField(v, id)
+		if f := And(c.Profile.Filter, v.Get("filterLogic")); f != "" {
+			v.Set("filterLogic", f)
+		}
+		if err := c.streamBatched(token, id, v, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// And combines REDCap logic expressions, empty expressions are left out
+func And(filters ...string) string {
+	var l []string
+	for _, f := range filters {
+		if f = strings.TrimSpace(f); f != "" {
+			l = append(l, f)
+		}
+	}
+	if len(l) == 1 {
+		return l[0]
+	}
+	for i, f := range l {
+		l[i] = "(" + f + ")"
+	}
+	return strings.Join(l, " and ")
+}
+
+// addField adds name to the fields of a record export
+func addField(values url.Values, name string) {
+	n := 0
+	for k := range values {
+		if strings.HasPrefix(k, "fields[") {
+			n++
+		}
+	}
+	values.Add("fields["+strconv.Itoa(n)+"]", name)
+}
+
+// recordIDs returns the ids of the records visible with token that are selected by the
+// filter in values
+func (c *Client) recordIDs(token string, id string, values url.Values) ([]string, error) {
+	v := recordValues()
+	v.Add("fields[0]", id)
+	if f := values.Get("filterLogic"); f != "" {
+		v.Set("filterLogic", f)
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	err := c.stream(token, v, func(elem map[string]string) error {
+		if r := elem[id]; !seen[r] {
+			seen[r] = true
+			ids = append(ids, r)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// streamBatched exports records for a token in batches of BatchSize record ids. Up to
+// Parallel batches are requested at the same time, fn is called for the records in the
+// order of the batches.
+func (c *Client) streamBatched(token string, id string, values url.Values, fn func(map[string]string) error) error {
+	if c.BatchSize <= 0 {
+		return c.stream(token, values, fn)
+	}
+	ids, err := c.recordIDs(token, id, values)
+	if err != nil {
+		return err
+	}
+	if len(ids) <= c.BatchSize {
+		return c.stream(token, values, fn)
+	}
+	parallel := c.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	type batch struct {
+		entries []map[string]string
+		err     error
+	}
+	results := make([]chan batch, 0, len(ids)/c.BatchSize+1)
+	for i := 0; i < len(ids); i += c.BatchSize {
+		results = append(results, make(chan batch, 1))
+	}
+	// a batch holds a slot until its records are handed to fn, this keeps
+	// at most parallel batches in memory
+	slots := make(chan struct{}, parallel)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := range results {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			v := url.Values{}
+			for k, vals := range values {
+				v[k] = vals
+			}
+			end := (i + 1) * c.BatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			for j, id := range ids[i*c.BatchSize : end] {
+				v.Add("records["+strconv.Itoa(j)+"]", id)
+			}
+			go func(res chan batch) {
+				var b batch
+				b.err = c.stream(token, v, func(elem map[string]string) error {
+					b.entries = append(b.entries, elem)
+					return nil
+				})
+				res <- b
+			}(results[i])
+		}
+	}()
+
+	for _, res := range results {
+		b := <-res
+		if b.err != nil {
+			return b.err
+		}
+		for _, elem := range b.entries {
+			if err := fn(elem); err != nil {
+				return err
+			}
+		}
+		<-slots
+	}
+	return nil
+}
+
+// records collects the records returned by streamRecords
+func (c *Client) records(values url.Values) ([]map[string]string, error) {
+	var ret []map[string]string
+	err := c.streamRecords(values, func(elem map[string]string) error {
+		ret = append(ret, elem)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// recordValues returns the parameters shared by all flat record exports
+func recordValues() url.Values {
+	values := url.Values{}
+	values.Add("content", "record")
+	values.Add("type", "flat")
+	values.Add("rawOrLabel", "raw")
+	values.Add("rawOrLabelHeaders", "raw")
+	values.Add("exportCheckboxLabel", "false")
+	values.Add("exportSurveyFields", "false")
+	values.Add("exportDataAccessGroups", "true") // this will only return something if the user has access to more than one data access group
+	return values
+}
+
+// GetParticipantsBySite will ask REDCap about the list of participants with the date fields
+// of the profile. Only the baseline event is exported unless events have date fields.
+func (c *Client) GetParticipantsBySite() ([]map[string]string, error) {
+	values := recordValues()
+	if c.Profile.DateField != "" {
+		addField(values, c.Profile.DateField)
+	}
+	events := make([]string, 0, len(c.Profile.DateFields))
+	for ev := range c.Profile.DateFields {
+		events = append(events, ev)
+	}
+	// a stable order keeps the request in the cache
+	sort.Strings(events)
+	for _, ev := range events {
+		addField(values, c.Profile.DateFields[ev])
+	}
+	if c.Profile.BaselineEvent != "" && len(events) == 0 {
+		values.Add("events[0]", c.Profile.BaselineEvent)
+	}
+	return c.records(values)
+}
+
+// GetInstruments returns the list of all instruments from REDCap
+func (c *Client) GetInstruments() ([]map[string]string, error) {
+	// we only need to call this once, the data dictionary is the same for all tokens
+	token, err := c.firstToken()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Add("content", "metadata")
+	return c.post(token, values)
+}
+
+// GetFormEventMapping returns the events and forms in an array
+func (c *Client) GetFormEventMapping() ([]map[string]string, error) {
+	token, err := c.firstToken()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Add("content", "formEventMapping")
+	dat, err := c.post(token, values)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]map[string]string, 0, len(dat))
+	for _, v := range dat {
+		ret = append(ret, map[string]string{
+			"unique_event_name": v["unique_event_name"],
+			"form":              v["form"],
+		})
+	}
+	return ret, nil
+}
+
+// GetDataAccessGroups returns the data access groups of the project with their
+// data_access_group_name and unique_group_name
+func (c *Client) GetDataAccessGroups() ([]map[string]string, error) {
+	token, err := c.firstToken()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Add("content", "dag")
+	return c.post(token, values)
+}
+
+// GetDataDictionary returns the data dictionary for the given list of instruments
+func (c *Client) GetDataDictionary(instruments []string) ([]map[string]string, error) {
+	// data dictionaries are the same regardless of account, use the first token
+	token, err := c.firstToken()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Add("content", "metadata")
+	for i, instrument := range instruments {
+		values.Add("forms["+strconv.Itoa(i)+"]", instrument)
+	}
+	return c.post(token, values)
+}
+
+// Export selects the data of a record export
+type Export struct {
+	// Forms and Fields are the exported instruments and fields.
+	Forms  []string
+	Fields []string
+	// Events limits the export to these events, all events are exported if it is empty.
+	Events []string
+	// Filter is REDCap logic that selects records in addition to the filter of the profile.
+	Filter string
+}
+
+// values returns the parameters of the export
+func (e Export) values() url.Values {
+	values := recordValues()
+	for i, f := range e.Forms {
+		values.Add("forms["+strconv.Itoa(i)+"]", f)
+	}
+	for i, f := range e.Fields {
+		values.Add("fields["+strconv.Itoa(i)+"]", f)
+	}
+	for i, ev := range e.Events {
+		values.Add("events["+strconv.Itoa(i)+"]", ev)
+	}
+	if e.Filter != "" {
+		values.Set("filterLogic", e.Filter)
+	}
+	return values
+}
+
+// Stream calls fn for every record of the export while they are received
+func (c *Client) Stream(e Export, fn func(map[string]string) error) error {
+	return c.streamRecords(e.values(), fn)
+}
+
+// GetInstrument returns the values for a single instrument
+func (c *Client) GetInstrument(instrument string) ([]map[string]string, error) {
+	return c.records(Export{Forms: []string{instrument}}.values())
+}
+
+// StreamInstrument calls fn for the values of every record of a single instrument while
+// they are received
+func (c *Client) StreamInstrument(instrument string, fn func(map[string]string) error) error {
+	return c.Stream(Export{Forms: []string{instrument}}, fn)
+}
+
+// GetMeasure returns a single measure
+func (c *Client) GetMeasure(measure string) ([]map[string]string, error) {
+	return c.records(Export{Fields: []string{measure}}.values())
+}
+
+// StreamMeasure calls fn for a single measure of every record while they are received
+func (c *Client) StreamMeasure(measure string, fn func(map[string]string) error) error {
+	return c.Stream(Export{Fields: []string{measure}}, fn)
+}
@@ -0,0 +1,251 @@
+package redcap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/HaukeBartsch/redcapfs/redcap/redcaptest"
+)
+
+func setupClientTest(t *testing.T) (*Client, *redcaptest.Server) {
+	srv, err := redcaptest.NewServer("../testdata")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	c, err := NewClient(srv.URL, []string{redcaptest.Token})
+	if err != nil {
+		srv.Close()
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if c.Profile, err = LoadProfile("../testdata/profile.yaml"); err != nil {
+		srv.Close()
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	return c, srv
+}
+
+func TestGetInstruments(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetInstruments()
+	if err != nil {
+		t.Fatalf("GetInstruments failed: %v", err)
+	}
+	if len(dat) != len(srv.Metadata) {
+		t.Fatalf("got %d fields, want %d", len(dat), len(srv.Metadata))
+	}
+	if dat[0]["field_name"] != "id_redcap" {
+		t.Errorf("first field is %q, want id_redcap", dat[0]["field_name"])
+	}
+}
+
+func TestGetFormEventMapping(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetFormEventMapping()
+	if err != nil {
+		t.Fatalf("GetFormEventMapping failed: %v", err)
+	}
+	if len(dat) != len(srv.FormEventMapping) {
+		t.Fatalf("got %d entries, want %d", len(dat), len(srv.FormEventMapping))
+	}
+	for _, v := range dat {
+		if v["form"] == "" || v["unique_event_name"] == "" {
+			t.Errorf("incomplete entry %v", v)
+		}
+	}
+}
+
+func TestGetDataAccessGroups(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetDataAccessGroups()
+	if err != nil || len(dat) != 3 {
+		t.Fatalf("got %v (%v), want 3 groups", dat, err)
+	}
+	if dat[0]["unique_group_name"] != "site_a" || dat[0]["data_access_group_name"] != "Site A" {
+		t.Errorf("got %v for the first group", dat[0])
+	}
+}
+
+func TestGetDataDictionary(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetDataDictionary([]string{"screener"})
+	if err != nil {
+		t.Fatalf("GetDataDictionary failed: %v", err)
+	}
+	if len(dat) != 3 {
+		t.Fatalf("got %d fields, want 3", len(dat))
+	}
+	for _, v := range dat {
+		if v["form_name"] != "screener" {
+			t.Errorf("field %q belongs to %q", v["field_name"], v["form_name"])
+		}
+	}
+}
+
+func TestGetInstrument(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetInstrument("screener")
+	if err != nil {
+		t.Fatalf("GetInstrument failed: %v", err)
+	}
+	// S003 is not enrolled
+	if len(dat) != 2 {
+		t.Fatalf("got %d records, want 2: %v", len(dat), dat)
+	}
+	for _, v := range dat {
+		if v["scrn_age"] == "" {
+			t.Errorf("record %q has no screener data", v["id_redcap"])
+		}
+		if _, ok := v["demo_weight"]; ok {
+			t.Errorf("record %q contains fields of another instrument", v["id_redcap"])
+		}
+		if v["redcap_data_access_group"] == "" {
+			t.Errorf("record %q has no data access group", v["id_redcap"])
+		}
+	}
+}
+
+func TestGetMeasure(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	dat, err := c.GetMeasure("scrn_sex")
+	if err != nil {
+		t.Fatalf("GetMeasure failed: %v", err)
+	}
+	if len(dat) != 2 {
+		t.Fatalf("got %d records, want 2", len(dat))
+	}
+	if _, ok := dat[0]["scrn_age"]; ok {
+		t.Errorf("measure export contains other fields: %v", dat[0])
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	c.Tokens = []string{"invalid"}
+	if _, err := c.GetInstruments(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v, want ErrUnauthorized", err)
+	}
+	c.Tokens = nil
+	if _, err := c.GetInstrument("screener"); err != ErrNoToken {
+		t.Fatalf("got %v, want ErrNoToken", err)
+	}
+}
+
+func TestStreamInstrument(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	n := 0
+	err := c.StreamInstrument("screener", func(v map[string]string) error {
+		n++
+		if v["id_redcap"] == "S003" {
+			t.Errorf("record %q is not enrolled", v["id_redcap"])
+		}
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("got %d records (%v), want 2", n, err)
+	}
+
+	// errors of the callback stop the export
+	stop := errors.New("stop")
+	n = 0
+	err = c.StreamMeasure("scrn_age", func(v map[string]string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("got %v after %d records, want the error of the callback after one", err, n)
+	}
+}
+
+func TestBatchedExport(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	c.BatchSize = 1
+	c.Parallel = 2
+	dat, err := c.GetInstrument("screener")
+	if err != nil {
+		t.Fatalf("GetInstrument failed: %v", err)
+	}
+	if len(dat) != 2 || dat[0]["id_redcap"] != "S001" || dat[1]["id_redcap"] != "S002" {
+		t.Fatalf("got %v, want S001 and S002 in order", dat)
+	}
+	batches := 0
+	for _, r := range srv.Requests() {
+		if r.Get("records[0]") != "" {
+			batches++
+			if r.Get("records[1]") != "" {
+				t.Errorf("batch is larger than BatchSize: %v", r)
+			}
+		}
+	}
+	if batches != 2 {
+		t.Errorf("got %d batches, want 2", batches)
+	}
+}
+
+func TestInvalidField(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	_, err := c.GetMeasure("no_such_field")
+	var e *Error
+	if !errors.Is(err, ErrInvalidField) || !errors.As(err, &e) || e.StatusCode != 400 {
+		t.Fatalf("got %v, want ErrInvalidField", err)
+	}
+	if !strings.Contains(e.Message, "no_such_field") {
+		t.Errorf("message %q does not name the field", e.Message)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	// the follow-up visit is kept, the filter refers to the baseline event
+	dat, err := c.GetInstrument("demographics")
+	if err != nil || len(dat) != 3 {
+		t.Fatalf("got %d records (%v), want 3", len(dat), err)
+	}
+	for _, r := range srv.Requests() {
+		if r.Get("content") == "record" && r.Get("filterLogic") != c.Profile.Filter {
+			t.Errorf("filter of the profile not sent: %v", r)
+		}
+	}
+
+	// without a profile all records are exported, identified by the first field
+	c.Profile = Profile{}
+	dat, err = c.GetInstrument("screener")
+	if err != nil || len(dat) != 3 {
+		t.Fatalf("got %d records (%v), want 3", len(dat), err)
+	}
+	if id, err := c.RecordID(); err != nil || id != "id_redcap" {
+		t.Errorf("got record id %q (%v), want id_redcap", id, err)
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	c, srv := setupClientTest(t)
+	defer srv.Close()
+
+	c.Profile.Filter = "[scrn_age] >"
+	if _, err := c.GetInstrument("screener"); err == nil || !strings.Contains(err.Error(), "filterLogic") {
+		t.Errorf("got %v, want the error reported by REDCap", err)
+	}
+}
@@ -0,0 +1,57 @@
+package redcap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors reported by REDCap, use errors.Is to check the cause of an *Error.
+var (
+	// ErrUnauthorized is returned for invalid tokens and missing API rights.
+	ErrUnauthorized = errors.New("redcap: not authorized")
+	// ErrInvalidField is returned if a requested field, form or event does not exist.
+	ErrInvalidField = errors.New("redcap: invalid field")
+	// ErrServer is returned if REDCap failed to answer the request.
+	ErrServer = errors.New("redcap: server error")
+	// ErrRateLimited is returned if REDCap refused requests because there were too many.
+	ErrRateLimited = errors.New("redcap: too many requests")
+)
+
+// Error is an error REDCap reported for a request
+type Error struct {
+	// Content is the content type of the failed request, e.g. record.
+	Content string
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Message is the error text returned by REDCap.
+	Message string
+	// Err is one of the Err values above, or nil if the cause is not known.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("redcap: %s request failed with %d %s: %s", e.Content, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// cause classifies an error response by its status and message
+func cause(status int, message string) error {
+	m := strings.ToLower(message)
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden,
+		strings.Contains(m, "permission"), strings.Contains(m, "token"):
+		return ErrUnauthorized
+	case status == http.StatusTooManyRequests, strings.Contains(m, "rate limit"), strings.Contains(m, "too many"):
+		return ErrRateLimited
+	case status >= 500:
+		return ErrServer
+	case strings.Contains(m, "not valid"), strings.Contains(m, "do not exist"), strings.Contains(m, "does not exist"):
+		return ErrInvalidField
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package redcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile describes the parts of a REDCap project that differ between
+// projects: the field that identifies a record, the records that are
+// exported and where the date of a record is found.
+type Profile struct {
+	// RecordID is the field that identifies a record, the first field of
+	// the data dictionary is used if it is empty.
+	RecordID string `yaml:"recordId" json:"recordId"`
+	// Filter is REDCap logic like "[enroll_total(1)] = '1'" that selects
+	// the exported records. It is sent as filterLogic with every record
+	// export, all records are exported if it is empty.
+	Filter string `yaml:"filter" json:"filter"`
+	// BaselineEvent is the event that holds DateField in longitudinal
+	// projects.
+	BaselineEvent string `yaml:"baselineEvent" json:"baselineEvent"`
+	// DateField is the date (or date and time) of a record that is used
+	// to select records by date.
+	DateField string `yaml:"dateField" json:"dateField"`
+	// DateFields maps events to the field with the date of the event,
+	// events that are not listed use DateField of the baseline event.
+	DateFields map[string]string `yaml:"dateFields" json:"dateFields"`
+}
+
+// LoadProfile reads a profile from a JSON file (.json) or a YAML file (any
+// other extension). Unknown keys are reported as errors.
+func LoadProfile(path string) (Profile, error) {
+	var p Profile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if filepath.Ext(path) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	} else {
+		err = yaml.UnmarshalStrict(data, &p)
+	}
+	if err != nil {
+		return p, fmt.Errorf("redcap: invalid profile %s: %v", path, err)
+	}
+	return p, nil
+}
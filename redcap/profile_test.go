@@ -0,0 +1,53 @@
+package redcap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	p, err := LoadProfile("../testdata/profile.yaml")
+	if err != nil {
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	want := Profile{
+		RecordID:      "id_redcap",
+		Filter:        "[baseline_year_1_arm_1][enroll_total(1)] = '1'",
+		BaselineEvent: "baseline_year_1_arm_1",
+		DateField:     "cp_timestamp_v2",
+		DateFields:    map[string]string{"1_year_follow_up_y_arm_1": "demo_visit_date"},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+
+	dir, err := ioutil.TempDir("", "redcap_profile")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, tc := range map[string]struct {
+		content string
+		ok      bool
+	}{
+		"profile.json": {`{"recordId": "record_id", "dateField": "visit_date"}`, true},
+		"unknown.json": {`{"recordID": "record_id", "date": "visit_date"}`, false},
+		"unknown.yaml": {"record_id: record_id\n", false},
+		"profile.yml":  {"recordId: record_id\ndateField: visit_date\n", true},
+		"invalid.yaml": {"recordId: [\n", false},
+		"empty.yaml":   {"", true},
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(tc.content), 0600)
+		p, err := LoadProfile(path)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", name, err)
+		}
+		if tc.ok && tc.content != "" && (p.RecordID != "record_id" || p.DateField != "visit_date") {
+			t.Errorf("%s: got %+v", name, p)
+		}
+	}
+}
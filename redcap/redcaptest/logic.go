@@ -0,0 +1,263 @@
+package redcaptest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// logic is a parsed REDCap logic expression as used by the filterLogic
+// parameter. Only the parts needed by tests are understood: field
+// references (with an optional event and checkbox code), quoted strings,
+// numbers, comparisons, and, or and parentheses.
+type logic interface {
+	eval(lookup func(event, field string) string) interface{}
+}
+
+type ref struct{ event, field string }
+
+type literal string
+
+type compare struct {
+	op   string
+	l, r logic
+}
+
+type junction struct {
+	and  bool
+	l, r logic
+}
+
+func (r ref) eval(lookup func(event, field string) string) interface{} {
+	return lookup(r.event, r.field)
+}
+
+func (l literal) eval(func(event, field string) string) interface{} {
+	return string(l)
+}
+
+func (c compare) eval(lookup func(event, field string) string) interface{} {
+	l, r := str(c.l.eval(lookup)), str(c.r.eval(lookup))
+	cmp := strings.Compare(l, r)
+	if a, err := strconv.ParseFloat(l, 64); err == nil {
+		if b, err := strconv.ParseFloat(r, 64); err == nil {
+			cmp = 0
+			if a < b {
+				cmp = -1
+			} else if a > b {
+				cmp = 1
+			}
+		}
+	} else if c.op != "=" && c.op != "<>" && c.op != "!=" && (l == "" || r == "") {
+		// blank values are neither smaller nor larger than anything
+		return false
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "<>", "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func (j junction) eval(lookup func(event, field string) string) interface{} {
+	if j.and {
+		return truth(j.l.eval(lookup)) && truth(j.r.eval(lookup))
+	}
+	return truth(j.l.eval(lookup)) || truth(j.r.eval(lookup))
+}
+
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	default:
+		return v.(string)
+	}
+}
+
+func truth(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	default:
+		return v != "" && v != "0"
+	}
+}
+
+// parseLogic parses a REDCap logic expression
+func parseLogic(s string) (logic, error) {
+	p := &logicParser{tokens: tokenize(s)}
+	l, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return l, nil
+}
+
+type logicParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *logicParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *logicParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *logicParser) or() (logic, error) {
+	l, err := p.and()
+	for err == nil && strings.EqualFold(p.peek(), "or") {
+		p.next()
+		var r logic
+		if r, err = p.and(); err == nil {
+			l = junction{and: false, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *logicParser) and() (logic, error) {
+	l, err := p.comparison()
+	for err == nil && strings.EqualFold(p.peek(), "and") {
+		p.next()
+		var r logic
+		if r, err = p.comparison(); err == nil {
+			l = junction{and: true, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *logicParser) comparison() (logic, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "=", "<>", "!=", "<", "<=", ">", ">=":
+		p.next()
+		r, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compare{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *logicParser) operand() (logic, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		l, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return l, nil
+	case t[0] == '[' || t[0] == '\'' || t[0] == '"':
+		if !terminated(t) {
+			return nil, fmt.Errorf("unterminated %q", t)
+		}
+		if t[0] != '[' {
+			return literal(t[1 : len(t)-1]), nil
+		}
+		r := ref{field: t[1 : len(t)-1]}
+		if next := p.peek(); strings.HasPrefix(next, "[") && terminated(next) {
+			p.next()
+			r = ref{event: r.field, field: next[1 : len(next)-1]}
+		}
+		// checkboxes are referenced as [field(code)]
+		if i := strings.Index(r.field, "("); i > 0 && strings.HasSuffix(r.field, ")") {
+			r.field = r.field[:i] + "___" + r.field[i+1:len(r.field)-1]
+		}
+		return r, nil
+	case unicode.IsDigit(rune(t[0])) || t[0] == '-' || t[0] == '.':
+		if _, err := strconv.ParseFloat(t, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q", t)
+		}
+		return literal(t), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+// terminated returns true if the reference or string t is closed
+func terminated(t string) bool {
+	end := t[0]
+	if end == '[' {
+		end = ']'
+	}
+	return len(t) > 1 && t[len(t)-1] == end
+}
+
+// tokenize splits a logic expression into references, strings, operators
+// and words
+func tokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '[' || c == '\'' || c == '"':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(s[i+1:], end)
+			if j < 0 {
+				// unterminated, the parser reports it
+				tokens = append(tokens, s[i:])
+				return tokens
+			}
+			tokens = append(tokens, s[i:i+j+2])
+			i += j + 2
+		case strings.HasPrefix(s[i:], "<>") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.IndexByte("()=<>", c) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\r\n[]'\"()=<>!", s[j]) < 0 {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,266 @@
+// Package redcaptest provides a stand-in for the REDCap API that can be used
+// in tests without network access.
+package redcaptest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Token is the only API token accepted by the server.
+const Token = "0123456789ABCDEF0123456789ABCDEF"
+
+// Server answers REDCap API requests from fixture data. It understands the
+// content types metadata, formEventMapping, dag and (flat) record, records can
+// be selected with a subset of the REDCap logic in filterLogic.
+type Server struct {
+	*httptest.Server
+
+	Metadata         []map[string]string
+	FormEventMapping []map[string]interface{}
+	Records          []map[string]string
+	DataAccessGroups []map[string]string
+
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+// NewServer starts a server with the fixtures metadata.json,
+// formEventMapping.json, records.json and dags.json found in dir.
+func NewServer(dir string) (*Server, error) {
+	s := &Server{}
+	if err := readFixture(filepath.Join(dir, "metadata.json"), &s.Metadata); err != nil {
+		return nil, err
+	}
+	if err := readFixture(filepath.Join(dir, "formEventMapping.json"), &s.FormEventMapping); err != nil {
+		return nil, err
+	}
+	if err := readFixture(filepath.Join(dir, "records.json"), &s.Records); err != nil {
+		return nil, err
+	}
+	if err := readFixture(filepath.Join(dir, "dags.json"), &s.DataAccessGroups); err != nil {
+		return nil, err
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s, nil
+}
+
+func readFixture(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Requests returns the parameters of all requests the server received so far.
+func (s *Server) Requests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.requests...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, r.PostForm)
+	s.mu.Unlock()
+
+	if r.PostForm.Get("token") != Token {
+		writeError(w, http.StatusForbidden, "You do not have permissions to use the API")
+		return
+	}
+	switch r.PostForm.Get("content") {
+	case "metadata":
+		writeJSON(w, s.metadata(list(r.PostForm, "forms")))
+	case "formEventMapping":
+		writeJSON(w, s.FormEventMapping)
+	case "dag":
+		writeJSON(w, s.DataAccessGroups)
+	case "record":
+		if invalid := s.unknownFields(list(r.PostForm, "fields")); len(invalid) > 0 {
+			writeError(w, http.StatusBadRequest, "The following values in the parameter \"fields\" are not valid: '"+strings.Join(invalid, "', '")+"'")
+			return
+		}
+		var filter logic
+		if f := r.PostForm.Get("filterLogic"); f != "" {
+			var err error
+			if filter, err = parseLogic(f); err != nil {
+				writeError(w, http.StatusBadRequest, "The value of the parameter \"filterLogic\" is not valid: "+err.Error())
+				return
+			}
+		}
+		writeJSON(w, s.records(r.PostForm, filter))
+	default:
+		writeError(w, http.StatusBadRequest, "The value of the parameter \"content\" is not valid")
+	}
+}
+
+// list returns the values of an array parameter like forms[0], forms[1], ...
+func list(values url.Values, name string) []string {
+	var ret []string
+	for k, v := range values {
+		if k == name || strings.HasPrefix(k, name+"[") {
+			ret = append(ret, v...)
+		}
+	}
+	return ret
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) metadata(forms []string) []map[string]string {
+	if len(forms) == 0 {
+		return s.Metadata
+	}
+	var ret []map[string]string
+	for _, entry := range s.Metadata {
+		if contains(forms, entry["form_name"]) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// unknownFields returns the fields that are not in the data dictionary
+func (s *Server) unknownFields(fields []string) []string {
+	var ret []string
+	for _, f := range fields {
+		found := false
+		for _, entry := range s.Metadata {
+			found = found || entry["field_name"] == f
+		}
+		if !found {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// columns returns the record columns that belong to the requested fields and
+// forms, checkbox fields are exported as field___code
+func (s *Server) columns(fields, forms []string) func(string) bool {
+	all := len(fields) == 0 && len(forms) == 0
+	recordID := ""
+	if len(s.Metadata) > 0 {
+		recordID = s.Metadata[0]["field_name"]
+	}
+	wanted := map[string]bool{recordID: true}
+	for _, f := range fields {
+		wanted[f] = true
+	}
+	for _, entry := range s.Metadata {
+		if contains(forms, entry["form_name"]) {
+			wanted[entry["field_name"]] = true
+		}
+	}
+	for _, f := range forms {
+		wanted[f+"_complete"] = true
+	}
+	return func(column string) bool {
+		if all || wanted[column] {
+			return true
+		}
+		if i := strings.Index(column, "___"); i > 0 {
+			return wanted[column[:i]]
+		}
+		return false
+	}
+}
+
+// lookup returns the value of a field of the record in row for event, or
+// of row itself if no event is given
+func (s *Server) lookup(recordID string, row map[string]string) func(event, field string) string {
+	return func(event, field string) string {
+		if event == "" {
+			return row[field]
+		}
+		for _, rec := range s.Records {
+			if rec[recordID] == row[recordID] && rec["redcap_event_name"] == event {
+				return rec[field]
+			}
+		}
+		return ""
+	}
+}
+
+func (s *Server) records(values url.Values, filter logic) []map[string]string {
+	fields := list(values, "fields")
+	forms := list(values, "forms")
+	events := list(values, "events")
+	ids := list(values, "records")
+	dag := values.Get("exportDataAccessGroups") == "true"
+	wanted := s.columns(fields, forms)
+	recordID := ""
+	if len(s.Metadata) > 0 {
+		recordID = s.Metadata[0]["field_name"]
+	}
+
+	// an export of the record id alone has a row for every record and event
+	onlyID := len(forms) == 0 && len(fields) > 0
+	for _, f := range fields {
+		onlyID = onlyID && f == recordID
+	}
+
+	ret := []map[string]string{}
+	for _, rec := range s.Records {
+		if len(events) > 0 && !contains(events, rec["redcap_event_name"]) {
+			continue
+		}
+		if len(ids) > 0 && !contains(ids, rec[recordID]) {
+			continue
+		}
+		if filter != nil && !truth(filter.eval(s.lookup(recordID, rec))) {
+			continue
+		}
+		row := make(map[string]string)
+		hasData := false
+		for k, v := range rec {
+			switch {
+			case k == "redcap_event_name":
+				row[k] = v
+			case k == "redcap_data_access_group":
+				if dag {
+					row[k] = v
+				}
+			case wanted(k):
+				row[k] = v
+				if k != recordID && v != "" {
+					hasData = true
+				}
+			}
+		}
+		// REDCap only returns rows for events that have data in the requested columns
+		if hasData || onlyID {
+			ret = append(ret, row)
+		}
+	}
+	return ret
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,206 @@
+package redcap
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport sends the requests of a client. Attempts that fail with a
+// network error, a timeout or a 5xx or 429 status are repeated after a
+// jittered exponential backoff, and requests to the same host are limited
+// by a token bucket.
+type Transport struct {
+	// Base sends the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+	// Timeout is the time to wait for the response headers of one attempt.
+	Timeout time.Duration
+	// Retries is the number of times a failed request is repeated.
+	Retries int
+	// MinBackoff and MaxBackoff limit the wait between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Rate is the number of requests per second sent to a host, Burst the
+	// number of requests that can be sent at once. Rate 0 disables the limit.
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewTransport returns a transport with defaults that fit the REDCap API
+// limit of 600 requests per minute.
+func NewTransport() *Transport {
+	return &Transport{
+		Timeout:    2 * time.Minute,
+		Retries:    4,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Rate:       10,
+		Burst:      10,
+	}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip sends the request and retries failed attempts
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.bucket(req.URL.Host).wait(req.Context()); err != nil {
+			return nil, err
+		}
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+		resp, err := t.attempt(r)
+
+		retry := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !retry || attempt >= t.Retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		wait := t.backoff(attempt)
+		if resp != nil {
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(s)*time.Second > wait {
+				wait = time.Duration(s) * time.Second
+			}
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt sends the request once, it is canceled if the response headers
+// do not arrive in time
+func (t *Transport) attempt(req *http.Request) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		return t.base().RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.Timeout, cancel)
+	resp, err := t.base().RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err != nil {
+		cancel()
+		return nil, &timeoutError{err}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff returns the time to wait after the given failed attempt
+func (t *Transport) backoff(attempt int) time.Duration {
+	d := t.MinBackoff << uint(attempt)
+	if d > t.MaxBackoff || d <= 0 {
+		d = t.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// full jitter keeps clients that failed together from retrying together
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (t *Transport) bucket(host string) *bucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[string]*bucket)
+	}
+	b, ok := t.buckets[host]
+	if !ok {
+		b = &bucket{rate: t.Rate, burst: float64(t.Burst), tokens: float64(t.Burst)}
+		if b.burst < 1 {
+			b.burst, b.tokens = 1, 1
+		}
+		t.buckets[host] = b
+	}
+	return b
+}
+
+// bucket is a token bucket that refills at rate tokens per second
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until a token is available and takes it
+func (b *bucket) wait(ctx context.Context) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	// a negative balance is the time the caller has to wait for its token
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancelBody releases the context of an attempt once the response is read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return "redcap: no response in time: " + e.err.Error()
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
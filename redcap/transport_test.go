@@ -0,0 +1,156 @@
+package redcap
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTransport retries quickly and does not limit the rate
+func testTransport() *Transport {
+	t := NewTransport()
+	t.MinBackoff = time.Millisecond
+	t.MaxBackoff = 5 * time.Millisecond
+	t.Rate = 0
+	return t
+}
+
+func setupTransportTest(handler http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	c, _ := NewClient(srv.URL, []string{"token"})
+	c.HTTP.Transport = testTransport()
+	c.BatchSize = 0
+	return c, srv
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	var calls int32
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		// the body is sent again for every attempt
+		if r.FormValue("content") != "metadata" {
+			t.Errorf("got content %q", r.FormValue("content"))
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"field_name": "id_redcap"}]`))
+	})
+	defer srv.Close()
+
+	dat, err := c.GetInstruments()
+	if err != nil || len(dat) != 1 {
+		t.Fatalf("got %v (%v), want one field", dat, err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d attempts, want 3", calls)
+	}
+}
+
+func TestNoRetryClientErrors(t *testing.T) {
+	var calls int32
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "The following values in the parameter \"fields\" are not valid: 'nope'"}`))
+	})
+	defer srv.Close()
+
+	_, err := c.GetMeasure("nope")
+	if !errors.Is(err, ErrInvalidField) || !strings.Contains(err.Error(), `are not valid: 'nope'`) {
+		t.Errorf("got %v, want the error reported by REDCap", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d attempts, want 1", calls)
+	}
+}
+
+func TestGiveUpAfterRetries(t *testing.T) {
+	var calls int32
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer srv.Close()
+
+	if _, err := c.GetInstruments(); !errors.Is(err, ErrServer) {
+		t.Errorf("got %v, want ErrServer", err)
+	}
+	if want := int32(c.HTTP.Transport.(*Transport).Retries + 1); calls != want {
+		t.Errorf("got %d attempts, want %d", calls, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var calls int32
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`[]`))
+	})
+	defer srv.Close()
+	c.HTTP.Transport.(*Transport).Timeout = 50 * time.Millisecond
+
+	if _, err := c.GetInstruments(); err != nil {
+		t.Errorf("second attempt should succeed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d attempts, want 2", calls)
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		// some errors are reported with status 200
+		w.Write([]byte(` {"error": "You do not have permissions to use the API"}`))
+	})
+	defer srv.Close()
+
+	_, err := c.GetInstruments()
+	if !errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "You do not have permissions") {
+		t.Errorf("got %v, want the error reported by REDCap", err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	var calls int32
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer srv.Close()
+	c.HTTP.Transport.(*Transport).Retries = 1
+
+	if _, err := c.GetInstruments(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v, want ErrRateLimited", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d attempts, want 2", calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, srv := setupTransportTest(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	defer srv.Close()
+	tr := c.HTTP.Transport.(*Transport)
+	tr.Rate = 50
+	tr.Burst = 1
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := c.GetInstruments(); err != nil {
+			t.Fatalf("GetInstruments failed: %v", err)
+		}
+	}
+	// the first request uses the burst, five more need 100ms at 50 per second
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("six requests took %v, the rate is not limited", d)
+	}
+}
@@ -4,25 +4,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/HaukeBartsch/redcapfs/nodefsC"
+	"github.com/HaukeBartsch/redcapfs/redcap"
 	"github.com/HaukeBartsch/redcapfs/utils"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/howeyc/gopass"
 )
 
-var participants []map[string]string
-var instruments []map[string]string
-var formEventMapping []map[string]string
-var mountPoint string
-var tokens map[string][]string
+// defaultFormat is used for files the application creates on its own, it is set with -format
+var defaultFormat = ".json"
+
+// refreshFile is the control file in the top directory that forces REDCap to be asked again
+const refreshFile = ".refresh"
 
 // For example: If the user creates a folder with a given name, can be use that folders name
 // to populate the directory created?
@@ -33,229 +35,409 @@ var tokens map[string][]string
 // Can we get stages of filters done this way as well? For example a directory tree could
 // represent an AND/OR. Maybe its easier to start on the highest level with all data and
 // only reduce the data in subsequent levels.
-func somethingHappened(path string, what string) {
+func (s *Session) somethingHappened(path string, what string) {
 	//fmt.Println("something happend on the file system, got ", path, what, "\n")
 
+	// touching .refresh drops the cached responses and reads the metadata again
+	if path == refreshFile && (what == "CREATE" || what == "UTIMENS") {
+		s.refreshInBackground()
+		return
+	}
+
+	// query files are run again whenever they are written
+	if filepath.Ext(path) == queryExt && (what == "WRITE" || what == "RENAME") {
+		go s.runQuery(path)
+		return
+	}
+
 	// ok we have access now to the path and to the instrument + participants
-	// we should do something if we see a CREATE event (== filename)
-	if (what == "CREATE") || (what == "RENAME") {
-		// we create a file in this directory
-		// lets use the filename and query REDCap with that variable
+	// the content of created files is filled by exportFile, here we only add
+	// the data dictionary of an instrument next to it
+	if what == "CREATE" {
 		ext := filepath.Ext(path)
-		if ext != ".json" && ext != ".csv" && ext != ".xlsx" {
+		if _, ok := utils.WriterFor(ext); !ok || isVirtual(path) {
+			return
+		}
+		variable := strings.TrimSuffix(filepath.Base(path), ext)
+		if !s.isInstrument(variable) {
 			return
 		}
-		path2 := strings.TrimSuffix(path, filepath.Ext(path))
-		l := strings.Split(path2, "/")
-		variable := l[len(l)-1]
-		//fmt.Println("Var:", variable)
+		s.addFile(strings.TrimSuffix(path, ext) + "_datadictionary" + ext)
+	} else if what == "MKDIR" {
+		// create a directory, could be event name or a collection. We might have to wait for
+		// the metadata, so the files are added in the background.
+		go s.addEventFiles(path)
+		go s.addCollectionFiles(path)
+	}
+}
 
-		dir, err := filepath.Abs(mountPoint)
-		if err != nil {
-			log.Fatal(err)
+// addEventFiles adds a file for every form of the event in the directory at path, if it is named
+// after an event. The files are in the format of the directory suffix (baseline_arm_1.csv) or in
+// the default format.
+func (s *Session) addEventFiles(path string) {
+	event, ext, ok := s.eventDir(filepath.Base(path))
+	if !ok {
+		return
+	}
+	if ext == "" {
+		ext = defaultFormat
+	}
+	_, _, mapping := s.metadata()
+	for _, v := range mapping {
+		if v["unique_event_name"] == event {
+			s.addFile(path + "/" + v["form"] + ext)
 		}
-		p := fmt.Sprintf("%s/%s", dir, path)
-		fmt.Println("path we will write: ", p)
-
-		if variable == "DataDictionary" {
-			if ext == ".json" {
-				go func() { utils.WriteAsJson(instruments, p) }()
-			} else if ext == ".csv" {
-				go func() { utils.WriteAsCsv(instruments, p) }()
-			} else if ext == ".xlsx" {
-				go func() { utils.WriteAsExcel(instruments, p) }()
-			} else {
-				fmt.Println("Error: this file extension is not known")
-			}
-			return
+	}
+}
+
+// eventDir returns the event of a directory named after it, the name can end with the
+// extension of a file format
+func (s *Session) eventDir(name string) (event string, ext string, ok bool) {
+	ext = filepath.Ext(name)
+	if _, known := utils.WriterFor(ext); !known {
+		ext = ""
+	}
+	event = strings.TrimSuffix(name, ext)
+	_, _, mapping := s.metadata()
+	for _, v := range mapping {
+		if v["unique_event_name"] == event {
+			return event, ext, true
 		}
+	}
+	return "", "", false
+}
 
-		// lets see if this is a variable or an instrument
-		inst := ""
-		meas := ""
-		for _, entry := range instruments {
-			//fmt.Println("test an instrument now: ", entry["form_name"], variable)
-			if entry["form_name"] == variable {
-				inst = variable
-				break
-			}
-			if entry["field_name"] == variable {
-				meas = variable
-				break
-			}
+// eventOf returns the event of the innermost event directory in path, or "" if there is none
+func (s *Session) eventOf(path string) string {
+	dirs := strings.Split(path, "/")
+	for i := len(dirs) - 2; i >= 0; i-- {
+		if event, _, ok := s.eventDir(dirs[i]); ok {
+			return event
 		}
+	}
+	return ""
+}
 
-		if inst != "" {
-			go func() {
-				in := utils.GetInstrument(inst, tokens)
-				dd := utils.GetDataDictionary([]string{inst}, tokens)
-				in = filterByDate(in, p)
-				ddname := strings.TrimSuffix(p, filepath.Ext(p)) + "_datadictionary" + filepath.Ext(p)
-				//in = filterBySite(in, p)
-				if ext == ".json" {
-					utils.WriteAsJson(in, p)
-					utils.WriteAsJson(dd, ddname)
-				} else if ext == ".csv" {
-					utils.WriteAsCsv(in, p)
-					utils.WriteAsCsv(dd, ddname)
-				} else if ext == ".xlsx" {
-					utils.WriteAsExcel(in, p)
-					utils.WriteAsExcel(dd, ddname)
-				} else {
-					fmt.Println("Error: unknown format to write")
-				}
-			}()
+// addFile adds the exported file at path to the mounted directory
+func (s *Session) addFile(path string) {
+	p, code := s.exportFile(path)
+	if code.Ok() && p == nil {
+		code = fuse.EINVAL
+	}
+	if code.Ok() {
+		code = nodefsC.NewFile(s.root, path, p)
+	}
+	if !code.Ok() {
+		fmt.Println("Error: could not add", path, code)
+	}
+}
+
+// isInstrument returns true if name is the form_name of an instrument
+func (s *Session) isInstrument(name string) bool {
+	_, dict, _ := s.metadata()
+	for _, entry := range dict {
+		if entry["form_name"] == name {
+			return true
 		}
-		if meas != "" {
-			go func() {
-				me := utils.GetMeasure(meas, tokens)
-				me = filterByDate(me, p)
-				//me = filterBySite(me, p)
-				if ext == ".json" {
-					utils.WriteAsJson(me, p)
-				} else if ext == ".csv" {
-					utils.WriteAsCsv(me, p)
-				} else if ext == ".xlsx" {
-					utils.WriteAsExcel(me, p)
-				} else {
-					fmt.Println("Error: unknown format to write")
-				}
-			}()
+	}
+	return false
+}
+
+// exportFile returns how the content of the file at path is exported from REDCap. The file
+// name is the name of an instrument, a measure, instruments and measures joined with + or a
+// data dictionary and its extension selects the format. Hidden files and query files are kept
+// as plain files, any other name is refused with ENOENT for unknown variables or EINVAL for
+// unknown extensions.
+func (s *Session) exportFile(path string) (nodefsC.Producer, fuse.Status) {
+	if strings.HasPrefix(filepath.Base(path), ".") || filepath.Ext(path) == queryExt {
+		return nil, fuse.OK
+	}
+	if g := groupOf(path); g != "" && !s.isGroup(g) {
+		return nil, fuse.ENOENT
+	}
+	ext := filepath.Ext(path)
+	w, ok := utils.WriterFor(ext)
+	if !ok {
+		return nil, fuse.EINVAL
+	}
+	_, dict, mapping := s.metadata()
+	write := func(what []map[string]string, out io.Writer) error {
+		return w.Write(what, dict, out)
+	}
+	variable := strings.TrimSuffix(filepath.Base(path), ext)
+
+	if variable == "DataDictionary" {
+		return func(w io.Writer) (int, error) {
+			return len(dict), write(dict, w)
+		}, fuse.OK
+	}
+	if variable == "EventMapping" {
+		return func(w io.Writer) (int, error) {
+			return len(mapping), write(mapping, w)
+		}, fuse.OK
+	}
+	if form := strings.TrimSuffix(variable, "_datadictionary"); form != variable && s.isInstrument(form) {
+		return func(w io.Writer) (int, error) {
+			dd, err := s.client.GetDataDictionary([]string{form})
+			if err != nil {
+				return 0, err
+			}
+			return len(dd), write(dd, w)
+		}, fuse.OK
+	}
+
+	e := redcap.Export{Filter: filterLogic(path)}
+	if event := s.eventOf(path); event != "" {
+		e.Events = []string{event}
+	}
+	// several instruments and fields joined into one table
+	if forms, fields, ok := joinedNames(variable, dict); ok {
+		e.Forms, e.Fields = forms, fields
+		return s.streamRecords(w, path, e, func(fn func(map[string]string) error) error {
+			return s.streamJoined(e, fn)
+		}), fuse.OK
+	}
+
+	// lets see if this is a variable or an instrument
+	inst := ""
+	meas := ""
+	for _, entry := range dict {
+		if entry["form_name"] == variable {
+			inst = variable
+			break
 		}
-		if (meas == "") && (inst == "") {
-			fmt.Println("Error: value is neither variable nor instrument ", variable)
+		if entry["field_name"] == variable {
+			meas = variable
+			break
 		}
-	} else if what == "MKDIR" {
-		// create a directory, could be event name
-		fmt.Println("asked to create a directory, could be event name...")
-		l := strings.Split(path, "/")
-		event := l[len(l)-1]
-		dir, err := filepath.Abs(mountPoint)
+	}
+
+	if inst != "" {
+		e.Forms = []string{inst}
+	} else if meas != "" {
+		e.Fields = []string{meas}
+	} else {
+		return nil, fuse.ENOENT
+	}
+	return s.streamRecords(w, path, e, func(fn func(map[string]string) error) error {
+		return s.client.Stream(e, fn)
+	}), fuse.OK
+}
+
+// streamRecords returns a producer that encodes the records of the export e while they are
+// received from REDCap, only the records that pass the filters of the path are written. The
+// columns of the output are described by the forms and fields of e.
+func (s *Session) streamRecords(w utils.Writer, path string, e redcap.Export, export func(func(map[string]string) error) error) nodefsC.Producer {
+	return func(out io.Writer) (int, error) {
+		_, dict, _ := s.metadata()
+		dict = utils.ExportDictionary(dict, e.Forms, e.Fields)
+		byDate, err := s.filterByDate(path)
 		if err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
-		p := fmt.Sprintf("%s/%s", dir, path)
-		for _, v := range formEventMapping {
-			if v["unique_event_name"] == event {
-				/* filename := fmt.Sprintf("%s/%s", p, v["form"])
-				fmt.Println("Found the event, write now form:", filename)
-				_, err := os.Stat(p)
-				if os.IsNotExist(err) {
-					fmt.Println("Error: directory does not exist yet")
-				}
-				go func(filename string) {
-					time.Sleep(500 * time.Millisecond)
-					fmt.Println("Found the event, write now form:", filename)
-					var nodata []map[string]string
-					// we might have to delay the creation of the file until the directory is really created...
-					utils.WriteAsJson(nodata, filename)
-				}(filename) */
-				// ok, we found unique_event_name, create its json representation underneath
-				time.Sleep(500 * time.Millisecond)
-				go func(form string) {
-					me := utils.GetInstrument(form, tokens)
-					me = filterByDate(me, p)
-					//me = filterBySite(me, p)
-					fn := fmt.Sprintf("%s/%s.json", p, form)
-					utils.WriteAsJson(me, fn)
-				}(v["form"])
+		byGroup, err := s.filterByGroup(path)
+		if err != nil {
+			return 0, err
+		}
+		keep := allOf(byDate, byGroup)
+		enc := utils.NewEncoder(w, dict, out)
+		err = export(func(entry map[string]string) error {
+			if keep != nil && !keep(entry) {
+				return nil
+			}
+			return enc.Encode(entry)
+		})
+		if err != nil {
+			return enc.Records(), err
+		}
+		return enc.Records(), enc.Close()
+	}
+}
+
+// allOf returns a filter for the records that pass all filters, nil filters are left out
+func allOf(filters ...func(map[string]string) bool) func(map[string]string) bool {
+	var l []func(map[string]string) bool
+	for _, f := range filters {
+		if f != nil {
+			l = append(l, f)
+		}
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return func(entry map[string]string) bool {
+		for _, f := range l {
+			if !f(entry) {
+				return false
 			}
 		}
+		return true
 	}
 }
 
-func filterBySite(what []map[string]string, path string) []map[string]string {
-	fmt.Println("filter by sites now")
-	// find out if we have a date field in the path
+// groupOf returns the data access group of path (dag/<group>/...), or "" if path is not in
+// the directory of a group
+func groupOf(path string) string {
 	l := strings.Split(path, "/")
-	var whatNew []map[string]string
+	if len(l) > 2 && l[0] == dagDir {
+		return l[1]
+	}
+	return ""
+}
+
+// isGroup returns true if name is the unique name of a data access group
+func (s *Session) isGroup(name string) bool {
+	for _, g := range s.groups() {
+		if g["unique_group_name"] == name {
+			return true
+		}
+	}
+	return false
+}
 
-	// find all sites that we have access to
-	sites := make(map[string]bool, 0)
-	for _, entry := range participants {
-		for k, v := range entry {
-			fmt.Println("entry has: ", k, " and ", v)
+// filterByGroup returns a filter for the records of the data access group in path, or nil if the
+// path is not in the directory of a group. The group of a record is looked up by its id.
+func (s *Session) filterByGroup(path string) (func(map[string]string) bool, error) {
+	group := groupOf(path)
+	if group == "" {
+		return nil, nil
+	}
+	participants, _, _ := s.metadata()
+	id, err := s.client.RecordID()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]string, len(participants))
+	for _, ps := range participants {
+		if g := ps["redcap_data_access_group"]; g != "" {
+			groups[ps[id]] = g
 		}
-		site := strings.Split(entry["redcap_data_access_group"], "_de")
-		if len(site) > 0 {
-			sites[strings.ToUpper(site[0])] = true
-		} else {
-			fmt.Println("did not find data access group")
+	}
+	return func(entry map[string]string) bool {
+		g, ok := groups[entry[id]]
+		if !ok {
+			g = entry["redcap_data_access_group"]
 		}
+		return g == group
+	}, nil
+}
+
+// filterByDate returns a filter for the records collected in the date ranges named by the
+// directories of path (see parseDateRange), or nil if there are none. The date of a record in an
+// event is taken from the date field of that event in the profile, events without one use the
+// date field of the baseline event. Without a date field in the profile the export fails.
+func (s *Session) filterByDate(path string) (func(map[string]string) bool, error) {
+	ranges := dateRanges(path)
+	if len(ranges) == 0 {
+		return nil, nil
 	}
-	for k := range sites {
-		fmt.Println("sites are:", k)
+	profile := s.client.Profile
+	if profile.DateField == "" && len(profile.DateFields) == 0 {
+		return nil, errors.New("set the dateField in the project profile to select records by date")
 	}
-	foundSiteString := false
-	for _, v := range l {
-		if v == "" {
-			continue
+	participants, _, _ := s.metadata()
+	id, err := s.client.RecordID()
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := make(map[string]time.Time, len(participants))
+	events := make(map[string]time.Time)
+	for _, ps := range participants {
+		ev := ps["redcap_event_name"]
+		if v := ps[profile.DateField]; v != "" && (profile.BaselineEvent == "" || ev == profile.BaselineEvent) {
+			if td, ok := parseDate(v); ok {
+				baseline[ps[id]] = td
+			} else {
+				fmt.Println("Could not parse baseline date from", v)
+			}
 		}
-		if sites[strings.ToUpper(v)] {
-			foundSiteString = true
-			fmt.Println("Found a site string, filter by this site", v)
-			for _, entry := range what {
-				p := entry["id_redcap"]
-				for _, ps := range participants {
-					if ps["id_redcap"] == p {
-						tsite := strings.Split(ps["redcap_data_access_group"], "_de")
-						if len(tsite) == 0 {
-							continue
-						}
-						if strings.ToUpper(tsite[0]) == strings.ToUpper(v) {
-							whatNew = append(whatNew, entry)
-						}
-					} else {
-						fmt.Println("Skip this entry", ps["id_redcap"], ". redcap_data_access_group ", ps["redcap_data_access_group"], "is not site", v)
-					}
-				}
+		if f, ok := profile.DateFields[ev]; ok && ps[f] != "" {
+			if td, ok := parseDate(ps[f]); ok {
+				events[ps[id]+"/"+ev] = td
+			} else {
+				fmt.Println("Could not parse the date of", ev, "from", ps[f])
 			}
 		}
 	}
-	if foundSiteString == false {
-		whatNew = what
-	}
-	return whatNew
+	return func(entry map[string]string) bool {
+		ev := entry["redcap_event_name"]
+		td, ok := baseline[entry[id]]
+		if _, perEvent := profile.DateFields[ev]; perEvent {
+			td, ok = events[entry[id]+"/"+ev]
+		}
+		if !ok {
+			return false
+		}
+		for _, r := range ranges {
+			if !r.contains(td) {
+				return false
+			}
+		}
+		return true
+	}, nil
 }
 
-func filterByDate(what []map[string]string, path string) []map[string]string {
-	// find out if we have a date field in the path
-	l := strings.Split(path, "/")
-	var whatNew []map[string]string
-	foundTimeString := false
-	for _, v := range l {
-		if v == "" {
-			continue
+// wherePrefix starts the name of a directory whose exports are filtered with REDCap logic
+const wherePrefix = "where "
+
+// filterLogic returns the REDCap logic of the where directories in path, records have to
+// match all of them
+func filterLogic(path string) string {
+	var l []string
+	dirs := strings.Split(path, "/")
+	for _, d := range dirs[:len(dirs)-1] {
+		if f, ok := whereLogic(d); ok {
+			l = append(l, f)
 		}
-		//fmt.Println("Test if", v, "is a time string")
-		t, err := time.Parse("Jan 2006", v)
-		if err == nil {
-			foundTimeString = true
-			// fmt.Println("Found a time string, filter by this date (same month as baseline)")
-			for _, entry := range what {
-				p := entry["id_redcap"]
-				for _, ps := range participants {
-					if ps["id_redcap"] == p {
-						// found the participant now look at its baseline date
-						td, err := time.Parse("2006-01-02 15:04", ps["cp_timestamp_v2"])
-						if err != nil {
-							fmt.Println("Could not parse baseline date from", ps["cp_timestamp_v2"])
-							continue
-						}
-						if (t.Month() == td.Month()) && (t.Year() == td.Year()) {
-							whatNew = append(whatNew, entry)
-						} else {
-							fmt.Println("Skip this entry", ps["id_redcap"], ". Date ", ps["cp_timestamp_v2"], "is not in requested range", v)
-						}
-					}
+	}
+	return redcap.And(l...)
+}
+
+// whereLogic returns the logic of a directory named "where <REDCap logic>", for example
+// "where [scrn_age] > 10 and [scrn_sex] = '1'". The operators can also be written as the
+// words eq, ne, lt, le, gt and ge, which need no quoting in the shell.
+func whereLogic(name string) (string, bool) {
+	if len(name) <= len(wherePrefix) || !strings.EqualFold(name[:len(wherePrefix)], wherePrefix) {
+		return "", false
+	}
+	operators := map[string]string{"eq": "=", "ne": "<>", "lt": "<", "le": "<=", "gt": ">", "ge": ">="}
+	var words []string
+	var quote rune
+	word := []rune{}
+	for _, c := range strings.TrimSpace(name[len(wherePrefix):]) + " " {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == ' ':
+			if len(word) > 0 {
+				w := string(word)
+				if op, ok := operators[strings.ToLower(w)]; ok {
+					w = op
 				}
+				words = append(words, w)
 			}
+			word = word[:0]
+			continue
 		}
+		word = append(word, c)
 	}
-	if foundTimeString == false {
-		whatNew = what
-	}
-	return whatNew
+	return strings.Join(words, " "), len(words) > 0
+}
+
+// mount creates the file system at dir, backing files are stored with the given prefix
+func (s *Session) mount(dir string, prefix string, debug bool) (*fuse.Server, error) {
+	s.root = nodefsC.NewFSNodeFSRoot(prefix, s.somethingHappened, s.listVirtual, s.exportFile)
+	conn := nodefsC.NewFileSystemConnector(s.root, nil)
+	return fuse.NewServer(conn.RawFS(), dir, &fuse.MountOptions{
+		Debug: debug,
+	})
 }
 
 func main() {
@@ -265,7 +447,20 @@ func main() {
 	showToken := flag.Bool("showToken", false, "show existing token")
 	clearAllTokens := flag.Bool("clearAllToken", false, "remove stored token")
 	setREDCap := flag.String("setREDCapURL", "https://abcd-rc.ucsd.edu/redcap/api/", "set the REDCap URL")
+	batchSize := flag.Int("batchSize", 500, "number of records per export request (0 exports all records at once)")
+	parallel := flag.Int("parallel", 4, "number of export requests sent at the same time")
+	refreshInterval := flag.Duration("refresh", 10*time.Minute, "time between checks for changes of the data dictionary and events (0 disables them)")
+	cacheDir := flag.String("cacheDir", "", "keep REDCap responses in this directory (no cache if empty)")
+	format := flag.String("format", "json", "format of the files created in event and collection directories without a format suffix")
+	profile := flag.String("profile", "", "read the record id field, the filter of exported records, the baseline event and the date field from this YAML or JSON file")
+	collections := flag.String("collections", "collections.yaml", "read the instruments and fields of workgroup collections from this YAML file")
+	cacheTTL := flag.String("cacheTTL", "10m", "time cached responses are used, for example 10m or record=10m,metadata=24h")
 	flag.Parse()
+	defaultFormat = "." + strings.TrimPrefix(*format, ".")
+	if _, ok := utils.WriterFor(defaultFormat); !ok {
+		fmt.Println("Error: unknown -format, use one of", utils.Extensions())
+		os.Exit(2)
+	}
 
 	// get the pass-phrase
 	fmt.Printf("This is a secured access. Provide your pass phrase: ")
@@ -274,8 +469,7 @@ func main() {
 		fmt.Println("Error: could not read pass-phrase")
 		panic(err)
 	}
-	// try to save this as a global variable
-	tokens = utils.TokenStoreGet(string(pw[:]))
+	tokens := utils.TokenStoreGet(string(pw[:]))
 	if *showToken == true {
 		str, err := json.Marshal(tokens)
 		if err != nil {
@@ -303,46 +497,53 @@ func main() {
 		os.Exit(2)
 	}
 
-	mountPoint = flag.Arg(0)
+	session, err := newSession(tokens)
+	if err != nil {
+		fmt.Println("Error: could not create a REDCap client")
+		panic(err)
+	}
+	session.collectionsFile = *collections
+	client := session.client
+	client.BatchSize = *batchSize
+	client.Parallel = *parallel
+	if *profile != "" {
+		client.Profile, err = redcap.LoadProfile(*profile)
+		if err != nil {
+			fmt.Println("Error: could not read the project profile", err)
+			os.Exit(2)
+		}
+	}
+	if *cacheDir != "" {
+		ttl, err := redcap.ParseTTL(*cacheTTL)
+		if err != nil {
+			fmt.Println("Error: could not read -cacheTTL", err)
+			os.Exit(2)
+		}
+		client.Cache, err = redcap.NewCache(*cacheDir, ttl)
+		if err != nil {
+			fmt.Println("Error: could not create the cache directory", err)
+			os.Exit(1)
+		}
+	}
+
 	prefix := "meme"
 	if flag.NArg() == 2 {
 		prefix = flag.Arg(1)
 	}
-	root := nodefsC.NewFSNodeFSRoot(prefix, somethingHappened)
-	conn := nodefsC.NewFileSystemConnector(root, nil)
-	server, err := fuse.NewServer(conn.RawFS(), mountPoint, &fuse.MountOptions{
-		Debug: *debug,
-	})
+	server, err := session.mount(flag.Arg(0), prefix, *debug)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Println("Mounted!")
 
-	// get values we might need later (or not)
-	participants = utils.GetParticipantsBySite(tokens)
-	instruments = utils.GetInstruments(tokens)
-	formEventMapping = utils.GetFormEventMapping(tokens)
-
-	go func() {
-		dir, err := filepath.Abs(mountPoint)
-		if err != nil {
-			log.Fatal(err)
-		}
-		p := fmt.Sprintf("%s/%s", dir, "DataDictionary.json")
-
-		fmt.Println("Writing data dictionary to ", p)
-		utils.WriteAsJson(instruments, p)
-	}()
+	// get values we might need later (or not), callbacks wait until they are read
 	go func() {
-		dir, err := filepath.Abs(mountPoint)
-		if err != nil {
-			log.Fatal(err)
+		session.loadMetadata()
+		session.writeProjectFiles()
+		if *refreshInterval > 0 {
+			session.refreshMetadata(*refreshInterval)
 		}
-		p := fmt.Sprintf("%s/%s", dir, "EventMapping.json")
-
-		fmt.Println("Writing event mapping to ", p)
-		utils.WriteAsJson(formEventMapping, p)
 	}()
 
 	server.Serve()
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func getxattr(path string, attr string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func TestMountStateXAttr(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	path := filepath.Join(wd, "scrn_age.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+	if _, err := ioutil.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	if state, err := getxattr(path, "user.redcapfs.state"); err != nil || state != "done" {
+		t.Errorf("got state %q (%v), want done", state, err)
+	}
+	if records, err := getxattr(path, "user.redcapfs.records"); err != nil || records != "2" {
+		t.Errorf("got %q records (%v), want 2", records, err)
+	}
+	if _, err := getxattr(path, "user.redcapfs.error"); err == nil {
+		t.Errorf("a successful export should not have an error attribute")
+	}
+}
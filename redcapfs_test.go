@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/HaukeBartsch/redcapfs/redcap"
+	"github.com/HaukeBartsch/redcapfs/redcap/redcaptest"
+	"github.com/HaukeBartsch/redcapfs/utils"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// setupREDCap returns a session for a local REDCap stand-in, the project metadata is loaded
+func setupREDCap(t *testing.T) (*Session, *redcaptest.Server) {
+	s, srv := newTestSession(t)
+	s.loadMetadata()
+	return s, srv
+}
+
+// newTestSession returns a session for a local REDCap stand-in that has not read the metadata yet
+func newTestSession(t *testing.T) (*Session, *redcaptest.Server) {
+	srv, err := redcaptest.NewServer("testdata")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	s, err := newSession(map[string][]string{
+		"REDCapURL":    {srv.URL},
+		"accessTokens": {redcaptest.Token},
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatalf("newSession failed: %v", err)
+	}
+	s.client.HTTP.Transport.(*redcap.Transport).Rate = 0
+	if s.client.Profile, err = redcap.LoadProfile("testdata/profile.yaml"); err != nil {
+		srv.Close()
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	// mount tests change the working directory
+	if s.collectionsFile, err = filepath.Abs("testdata/collections.yaml"); err != nil {
+		srv.Close()
+		t.Fatalf("Abs failed: %v", err)
+	}
+	return s, srv
+}
+
+// setupMountTest mounts the file system on a temporary directory, backing files are kept next to it
+func setupMountTest(t *testing.T, s *Session) (wd string, clean func()) {
+	tmp, err := ioutil.TempDir("", "redcapfs_test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	cwd, _ := os.Getwd()
+	os.Chdir(tmp)
+	mnt := filepath.Join(tmp, "mnt")
+	os.Mkdir(mnt, 0700)
+
+	server, err := s.mount(mnt, "test", false)
+	if err != nil {
+		os.Chdir(cwd)
+		os.RemoveAll(tmp)
+		t.Skipf("cannot mount a fuse file system here: %v", err)
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		t.Fatal("WaitMount", err)
+	}
+	return mnt, func() {
+		server.Unmount()
+		os.Chdir(cwd)
+		os.RemoveAll(tmp)
+	}
+}
+
+// csvRows returns a check that accepts complete csv files with n rows (including the header)
+func csvRows(n int) func([]byte) bool {
+	return func(data []byte) bool {
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		return err == nil && len(rows) == n
+	}
+}
+
+// export runs the producer of path and returns the number of records and what was written
+func export(t *testing.T, s *Session, path string) (int, []byte) {
+	p, code := s.exportFile(path)
+	if !code.Ok() || p == nil {
+		t.Fatalf("%s is not exported: %v", path, code)
+	}
+	var b bytes.Buffer
+	n, err := p(&b)
+	if err != nil {
+		t.Fatalf("export of %s failed: %v", path, err)
+	}
+	return n, b.Bytes()
+}
+
+func TestExportInstrument(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	// two enrolled participants have screener data
+	n, data := export(t, s, "screener.csv")
+	if n != 2 || !csvRows(3)(data) {
+		t.Fatalf("got %d records, want 2: %q", n, data)
+	}
+	rows, _ := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	header := map[string]bool{}
+	for _, h := range rows[0] {
+		header[h] = true
+	}
+	for _, want := range []string{"id_redcap", "redcap_event_name", "scrn_age", "scrn_sex"} {
+		if !header[want] {
+			t.Errorf("column %s missing in %v", want, rows[0])
+		}
+	}
+	if header["demo_weight"] {
+		t.Errorf("screener.csv contains columns of other instruments: %v", rows[0])
+	}
+	// columns follow the data dictionary
+	want := []string{"id_redcap", "redcap_event_name", "redcap_data_access_group", "scrn_age", "scrn_sex", "scrn_notes", "screener_complete"}
+	if !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("got columns %v, want %v", rows[0], want)
+	}
+	if n, data := export(t, s, "screener_datadictionary.csv"); n != 3 || !csvRows(4)(data) {
+		t.Errorf("got %d fields in the data dictionary, want 3: %q", n, data)
+	}
+}
+
+func TestExportMeasure(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	_, data := export(t, s, "scrn_age.json")
+	var dat []map[string]string
+	if err := json.Unmarshal(data, &dat); err != nil || len(dat) != 2 {
+		t.Errorf("got %v (%v), want 2 records", dat, err)
+	}
+}
+
+func TestExportByDate(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC) }
+
+	// baseline visits are dated by cp_timestamp_v2, the follow-up by demo_visit_date
+	for dir, want := range map[string][]string{
+		"2019-06":                           {"S001 baseline", "S002 baseline"},
+		"Jan 2019":                          {"S001 baseline"},
+		"until-2019-06-02":                  {"S001 baseline"},
+		"2020-01":                           {"S001 baseline", "S001 follow-up", "S002 baseline"},
+		"2019-06..2020-01":                  {"S001 follow-up", "S002 baseline"},
+		"last-30d":                          {"S001 follow-up"},
+		"2019-06..2020-01/until-2019-12-31": {"S002 baseline"},
+		"2020-01/2019-02..2019-12":          {"S002 baseline"},
+		"2018-12":                           nil,
+	} {
+		_, data := export(t, s, dir+"/demographics.jsonl")
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec map[string]string
+			if json.Unmarshal([]byte(line), &rec) == nil {
+				got = append(got, rec["id_redcap"]+" "+map[string]string{"baseline_year_1_arm_1": "baseline", "1_year_follow_up_y_arm_1": "follow-up"}[rec["redcap_event_name"]])
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", dir, got, want)
+		}
+	}
+
+	// without a date field nothing can be selected by date
+	s.client.Profile.DateField, s.client.Profile.DateFields = "", nil
+	p, code := s.exportFile("2019-06/demographics.csv")
+	if !code.Ok() {
+		t.Fatalf("got %v", code)
+	}
+	if _, err := p(ioutil.Discard); err == nil || !strings.Contains(err.Error(), "dateField") {
+		t.Errorf("the export should fail without a date field, got %v", err)
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	for name, want := range map[string]dateRange{
+		"2019-06":          {to: day("2019-07-01")},
+		"2019-06-30":       {to: day("2019-07-01")},
+		"until-2019-06-30": {to: day("2019-07-01")},
+		"until-2019-12":    {to: day("2020-01-01")},
+		"2019-01..2019-06": {from: day("2019-01-01"), to: day("2019-07-01")},
+		"Jun 2019":         {to: day("2019-07-01")},
+	} {
+		if got, ok := parseDateRange(name); !ok || got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	for _, name := range []string{"2019", "2019-13", "until-", "2019-06..2019-01", "last-d", "last-0d", "last-3x", "screener"} {
+		if _, ok := parseDateRange(name); ok {
+			t.Errorf("%s should not be a date range", name)
+		}
+	}
+}
+
+func TestExportWhere(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	// nested directories are combined, S003 is older but not enrolled
+	n, data := export(t, s, "where [scrn_age] ge 10/where [scrn_sex] = '1'/screener.csv")
+	if n != 1 || !bytes.Contains(data, []byte("S001")) {
+		t.Errorf("got %d records, want S001: %q", n, data)
+	}
+	reqs := srv.Requests()
+	want := "([baseline_year_1_arm_1][enroll_total(1)] = '1') and (([scrn_age] >= 10) and ([scrn_sex] = '1'))"
+	if f := reqs[len(reqs)-1].Get("filterLogic"); f != want {
+		t.Errorf("got filterLogic %q, want %q", f, want)
+	}
+}
+
+func TestWhereLogic(t *testing.T) {
+	for name, want := range map[string]string{
+		"where [age] > 10 and [sex] = '1'":  "[age] > 10 and [sex] = '1'",
+		"Where [age] gt 10  AND [sex] eq 1": "[age] > 10 AND [sex] = 1",
+		"where [notes] = 'lt or gt'":        "[notes] = 'lt or gt'",
+		"where [visit][le] le 3":            "[visit][le] <= 3",
+	} {
+		if got, ok := whereLogic(name); !ok || got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"where", "where ", "where   ", "somewhere [age] > 10", "screener.csv"} {
+		if got, ok := whereLogic(name); ok {
+			t.Errorf("%q is not a where directory, got %q", name, got)
+		}
+	}
+}
+
+func TestExportByGroup(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	// S003 is in site_b as well but not enrolled
+	n, data := export(t, s, "dag/site_b/screener.csv")
+	if n != 1 || !bytes.Contains(data, []byte("S002")) {
+		t.Errorf("got %d records, want S002: %q", n, data)
+	}
+	if n, _ := export(t, s, "dag/site_c/screener.csv"); n != 0 {
+		t.Errorf("got %d records for an empty group", n)
+	}
+	if _, code := s.exportFile("dag/site_x/screener.csv"); code != fuse.ENOENT {
+		t.Errorf("got %v for an unknown group, want ENOENT", code)
+	}
+
+	// records cannot be assigned to groups without the record id field
+	s.client.Profile.RecordID = ""
+	srv.Metadata = nil
+	if _, err := s.filterByGroup("dag/site_a/screener.csv"); err == nil {
+		t.Errorf("filterByGroup should fail without a record id")
+	}
+	p, code := s.exportFile("dag/site_a/screener.csv")
+	if !code.Ok() {
+		t.Fatalf("got %v", code)
+	}
+	if n, err := p(ioutil.Discard); err == nil {
+		t.Errorf("got %d records, want the export to fail without a record id", n)
+	}
+}
+
+func TestExportEvent(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path, event string
+		records     int
+	}{
+		{"1_year_follow_up_y_arm_1/demographics.csv", "1_year_follow_up_y_arm_1", 1},
+		{"1_year_follow_up_y_arm_1.csv/demographics.json", "1_year_follow_up_y_arm_1", 1},
+		{"events/baseline_year_1_arm_1/demographics.csv", "baseline_year_1_arm_1", 2},
+		{"baseline_year_1_arm_1/2019-06/demographics.csv", "baseline_year_1_arm_1", 2},
+		{"demographics.csv", "", 3},
+	} {
+		n, _ := export(t, s, tc.path)
+		reqs := srv.Requests()
+		if event := reqs[len(reqs)-1].Get("events[0]"); event != tc.event {
+			t.Errorf("%s: got event %q, want %q", tc.path, event, tc.event)
+		}
+		if n != tc.records {
+			t.Errorf("%s: got %d records, want %d", tc.path, n, tc.records)
+		}
+	}
+}
+
+func TestExportJoined(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	// screener at baseline and demographics at baseline and follow-up
+	n, data := export(t, s, "screener+demographics.csv")
+	if n != 3 || !csvRows(4)(data) {
+		t.Fatalf("got %d records, want 3: %q", n, data)
+	}
+	reqs := srv.Requests()
+	if r := reqs[len(reqs)-1]; r.Get("forms[0]") != "screener" || r.Get("forms[1]") != "demographics" {
+		t.Errorf("both instruments should be exported with one request, got %v", r)
+	}
+	rows, _ := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	header := strings.Join(rows[0], ",")
+	if !strings.Contains(header, "scrn_age") || !strings.Contains(header, "demo_weight") {
+		t.Errorf("header should contain the fields of both instruments: %s", header)
+	}
+
+	// a field of a joined instrument is a single column in the order of the data dictionary
+	_, data = export(t, s, "screener+scrn_age.csv")
+	rows, _ = csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if want := []string{"id_redcap", "redcap_event_name", "redcap_data_access_group", "scrn_age", "scrn_sex", "scrn_notes", "screener_complete"}; !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("got header %v, want %v", rows[0], want)
+	}
+
+	if _, code := s.exportFile("screener+no_such_thing.csv"); code != fuse.ENOENT {
+		t.Errorf("got %v for an unknown instrument, want ENOENT", code)
+	}
+}
+
+func TestJoiner(t *testing.T) {
+	var rows []map[string]string
+	j := &joiner{
+		id: "id",
+		emit: func(row map[string]string) error {
+			rows = append(rows, row)
+			return nil
+		},
+	}
+	for _, entry := range []map[string]string{
+		{"id": "1", "redcap_event_name": "e1", "a": "x", "b": ""},
+		{"id": "1", "redcap_event_name": "e1", "a": "", "b": "y"},
+		{"id": "1", "redcap_event_name": "e2", "a": "z", "b": ""},
+	} {
+		if err := j.add(entry); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+	if err := j.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	want := []map[string]string{
+		{"id": "1", "redcap_event_name": "e1", "a": "x", "b": "y"},
+		{"id": "1", "redcap_event_name": "e2", "a": "z", "b": ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, _, err := parseQuery([]byte("fields: [scrn_age, demo_weight]\nevents: [baseline_year_1_arm_1]\nfilterLogic: \"[scrn_age] > 9\"\nformat: csv\n"))
+	if err != nil {
+		t.Fatalf("parseQuery failed: %v", err)
+	}
+	want := query{
+		Fields:      []string{"scrn_age", "demo_weight"},
+		Events:      []string{"baseline_year_1_arm_1"},
+		FilterLogic: "[scrn_age] > 9",
+		Format:      "csv",
+	}
+	if !reflect.DeepEqual(q, want) || q.ext() != ".csv" {
+		t.Errorf("got %+v, want %+v", q, want)
+	}
+	if q, known, err := parseQuery([]byte("fields: [scrn_age]")); err != nil || !known || q.ext() != defaultFormat {
+		t.Errorf("got %q (%v), want the default format", q.ext(), err)
+	}
+	for _, data := range []string{"", "events: [baseline_year_1_arm_1]", "fields: [scrn_age]\nformat: txt", "fields: [scrn_age]\nfilter: x"} {
+		if _, _, err := parseQuery([]byte(data)); err == nil {
+			t.Errorf("%q should not be accepted", data)
+		}
+	}
+	// the format of an invalid query is known if it can be read
+	for data, want := range map[string]string{
+		"format: csv": ".csv",
+		"fields: [scrn_age]\nfilter: x\nformat: xlsx": ".xlsx",
+		"fields: [scrn_age]\nformat: txt":             "",
+		"fields: [scrn_age\nformat: csv":              "",
+	} {
+		q, known, err := parseQuery([]byte(data))
+		got := ""
+		if known {
+			got = q.ext()
+		}
+		if err == nil || got != want {
+			t.Errorf("%q: got %q (%v), want %q and an error", data, got, err, want)
+		}
+	}
+}
+
+func TestExportQuery(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	q := query{Fields: []string{"scrn_age", "demo_weight"}, FilterLogic: "[scrn_age] > 9", Format: "csv"}
+	out, p := s.queryExport("baseline_year_1_arm_1/myquery.rcq", q)
+	if out != "baseline_year_1_arm_1/myquery.csv" {
+		t.Errorf("got %s, want myquery.csv next to the query", out)
+	}
+	var b bytes.Buffer
+	if n, err := p(&b); err != nil || n != 1 || !bytes.Contains(b.Bytes(), []byte("S001")) {
+		t.Errorf("got %d records (%v), want S001: %q", n, err, b.Bytes())
+	}
+	reqs := srv.Requests()
+	r := reqs[len(reqs)-1]
+	if r.Get("events[0]") != "baseline_year_1_arm_1" || r.Get("fields[1]") != "demo_weight" || !strings.Contains(r.Get("filterLogic"), "[scrn_age] > 9") {
+		t.Errorf("the query is not sent to REDCap: %v", r)
+	}
+}
+
+func TestEventDir(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	for name, want := range map[string][2]string{
+		"baseline_year_1_arm_1":         {"baseline_year_1_arm_1", ""},
+		"baseline_year_1_arm_1.xlsx":    {"baseline_year_1_arm_1", ".xlsx"},
+		"1_year_follow_up_y_arm_1.json": {"1_year_follow_up_y_arm_1", ".json"},
+	} {
+		if event, ext, ok := s.eventDir(name); !ok || event != want[0] || ext != want[1] {
+			t.Errorf("%s: got %q %q %v, want %v", name, event, ext, ok, want)
+		}
+	}
+	for _, name := range []string{"baseline_year_1_arm_1.txt", "screener.csv", "baseline"} {
+		if _, _, ok := s.eventDir(name); ok {
+			t.Errorf("%s is not an event directory", name)
+		}
+	}
+}
+
+func TestCollectionDir(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	c, ext, ok := s.collectionDir("collections/neurocog.csv")
+	if !ok || ext != ".csv" {
+		t.Fatalf("got %q %v, want the csv collection neurocog", ext, ok)
+	}
+	if want := (collection{Instruments: []string{"screener", "demographics"}, Fields: []string{"scrn_age"}}); !reflect.DeepEqual(c, want) {
+		t.Errorf("got %v, want %v", c, want)
+	}
+	if _, _, ok := s.collectionDir("dag/site_a/collections/neurocog"); !ok {
+		t.Errorf("collections can be nested in other directories")
+	}
+	for _, path := range []string{"neurocog", "collections/unknown", "collections"} {
+		if _, _, ok := s.collectionDir(path); ok {
+			t.Errorf("%s is not a collection directory", path)
+		}
+	}
+
+	s.collectionsFile = "testdata/missing.yaml"
+	if _, _, ok := s.collectionDir("collections/neurocog"); ok {
+		t.Errorf("there are no collections without a file")
+	}
+	if root := names(s.listVirtual("")); root[collectionsDir] {
+		t.Errorf("collections should only be listed if there are any")
+	}
+}
+
+func TestExportUnknown(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	before := len(srv.Requests())
+	for name, want := range map[string]fuse.Status{
+		"no_such_thing.csv":            fuse.ENOENT,
+		"screener_datadictionary2.csv": fuse.ENOENT,
+		"notes.txt":                    fuse.EINVAL,
+		"screener":                     fuse.EINVAL,
+		".DS_Store":                    fuse.OK,
+		"myquery.rcq":                  fuse.OK,
+	} {
+		if p, code := s.exportFile(name); p != nil || code != want {
+			t.Errorf("got %v for %s, want %v", code, name, want)
+		}
+	}
+	if n := len(srv.Requests()); n != before {
+		t.Errorf("unknown names should not be exported, got %d requests", n-before)
+	}
+}
+
+func TestMountCreateUnknown(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	for name, want := range map[string]syscall.Errno{
+		"no_such_thing.csv": syscall.ENOENT,
+		"notes.txt":         syscall.EINVAL,
+	} {
+		_, err := os.Create(filepath.Join(wd, name))
+		if perr, ok := err.(*os.PathError); !ok || perr.Err != want {
+			t.Errorf("got %v for %s, want %v", err, name, want)
+		}
+		if _, err := os.Stat(filepath.Join(wd, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestMountFailedExport(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	s.client.Tokens = []string{"invalid"}
+	f, err := os.Create(filepath.Join(wd, "screener.csv"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+
+	_, err = ioutil.ReadFile(filepath.Join(wd, "screener.csv"))
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EIO {
+		t.Errorf("got %v for a failed export, want EIO", err)
+	}
+	status, _ := ioutil.ReadFile(filepath.Join(wd, "screener.csv.status"))
+	for _, want := range []string{"state: failed", "You do not have permissions"} {
+		if !strings.Contains(string(status), want) {
+			t.Errorf("status %q should report the failure", status)
+		}
+	}
+}
+
+func TestMountTouchInstrument(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+	s.writeProjectFiles()
+
+	// project files are readable right away
+	data, err := ioutil.ReadFile(filepath.Join(wd, "DataDictionary.json"))
+	var dat []map[string]string
+	if err != nil || json.Unmarshal(data, &dat) != nil || len(dat) != len(srv.Metadata) {
+		t.Errorf("DataDictionary.json is incomplete (%v): %q", err, data)
+	}
+
+	f, err := os.Create(filepath.Join(wd, "screener.csv"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+
+	// reads block until the export is done
+	data, err = ioutil.ReadFile(filepath.Join(wd, "screener.csv"))
+	if err != nil || !csvRows(3)(data) {
+		t.Errorf("screener.csv is incomplete (%v): %q", err, data)
+	}
+	// the kernel was told about the new size
+	if fi, err := os.Stat(filepath.Join(wd, "screener.csv")); err != nil || fi.Size() != int64(len(data)) {
+		t.Errorf("stale size of screener.csv (%v): %v, want %d", err, fi, len(data))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(wd, "screener_datadictionary.csv")); err != nil || !csvRows(4)(data) {
+		t.Errorf("screener_datadictionary.csv is incomplete (%v): %q", err, data)
+	}
+
+	entries, err := ioutil.ReadDir(wd)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	for _, want := range []string{"DataDictionary.json", "EventMapping.json", "screener.csv", "screener_datadictionary.csv"} {
+		if !found[want] {
+			t.Errorf("%s missing in mounted directory: %v", want, found)
+		}
+	}
+}
+
+func TestMountStatus(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	f, err := os.Create(filepath.Join(wd, "screener.csv"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+	if _, err := ioutil.ReadFile(filepath.Join(wd, "screener.csv")); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	status, err := ioutil.ReadFile(filepath.Join(wd, "screener.csv.status"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	for _, want := range []string{"state: done", "records: 2"} {
+		if !strings.Contains(string(status), want) {
+			t.Errorf("status %q does not contain %q", status, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(wd, "nothing.csv.status")); !os.IsNotExist(err) {
+		t.Errorf("got %v for the status of a missing file, want ENOENT", err)
+	}
+
+	entries, err := ioutil.ReadDir(wd)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".status") {
+			t.Errorf("status file %s should not be listed", e.Name())
+		}
+	}
+}
+
+func TestMountRefresh(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+	cache, err := redcap.NewCache(filepath.Join(wd, "..", "cache"), map[string]time.Duration{"": time.Hour})
+	if err != nil {
+		t.Fatalf("NewCache failed: %v", err)
+	}
+	s.client.Cache = cache
+	s.loadMetadata()
+
+	// metadata is answered from the cache until .refresh is touched
+	n := len(srv.Requests())
+	s.loadMetadata()
+	if len(srv.Requests()) != n {
+		t.Errorf("metadata should be read from the cache")
+	}
+	// the requests of a single refresh
+	s.refresh()
+	per := len(srv.Requests()) - n
+
+	// touch creates the file and sets its times, REDCap is asked once in the background
+	for _, touch := range []func(string) error{
+		func(name string) error {
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			now := time.Now()
+			return os.Chtimes(name, now, now)
+		},
+		func(name string) error {
+			now := time.Now()
+			return os.Chtimes(name, now, now)
+		},
+	} {
+		n = len(srv.Requests())
+		if err := touch(filepath.Join(wd, ".refresh")); err != nil {
+			t.Fatalf("touch failed: %v", err)
+		}
+		for i := 0; i < 100 && s.isRefreshing(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := len(srv.Requests()) - n; got != per {
+			t.Errorf("touching .refresh sent %d requests, want the %d of one refresh", got, per)
+		}
+	}
+
+	// a listed file is exported again after a refresh
+	name := filepath.Join(wd, "instruments", "screener.csv")
+	if _, err := ioutil.ReadFile(name); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	s.refresh()
+	n = len(srv.Requests())
+	if _, err := ioutil.ReadFile(name); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if len(srv.Requests()) == n {
+		t.Errorf("screener.csv was not exported again after a refresh")
+	}
+}
+
+func names(entries []fuse.DirEntry) map[string]bool {
+	ret := map[string]bool{}
+	for _, e := range entries {
+		ret[e.Name] = true
+	}
+	return ret
+}
+
+func TestListVirtual(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	root := names(s.listVirtual(""))
+	for _, d := range virtualDirs {
+		if !root[d] {
+			t.Errorf("%s missing in the root directory", d)
+		}
+	}
+	inst := names(s.listVirtual("instruments"))
+	for _, want := range []string{"screener.csv", "screener.json", "screener.xlsx", "demographics.csv"} {
+		if !inst[want] {
+			t.Errorf("instruments/%s missing in %v", want, inst)
+		}
+	}
+	if ev := names(s.listVirtual("events")); len(ev) != 2 {
+		t.Errorf("expected two events, got %v", ev)
+	}
+	followUp := names(s.listVirtual("events/1_year_follow_up_y_arm_1"))
+	if len(followUp) != 1 || !followUp["demographics.csv"] {
+		t.Errorf("follow-up should only contain demographics.csv, got %v", followUp)
+	}
+	if fields := s.listVirtual("fields"); len(fields) != len(srv.Metadata) {
+		t.Errorf("got %d fields, want %d", len(fields), len(srv.Metadata))
+	}
+	if dags := names(s.listVirtual("dag")); len(dags) != 3 || !dags["site_a"] {
+		t.Errorf("got groups %v, want site_a, site_b and site_c", dags)
+	}
+	if !root[collectionsDir] {
+		t.Errorf("collections missing in the root directory")
+	}
+	if l := s.listVirtual("somewhere/else"); len(l) != 0 {
+		t.Errorf("user directories should not be populated, got %v", l)
+	}
+}
+
+func TestReloadMetadata(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+
+	if s.loadMetadata() {
+		t.Errorf("metadata did not change")
+	}
+	srv.Metadata = append(srv.Metadata, map[string]string{
+		"field_name": "scrn_height", "form_name": "screener", "field_type": "text",
+	})
+	srv.FormEventMapping = srv.FormEventMapping[:1]
+	if !s.loadMetadata() {
+		t.Errorf("the new field was not noticed")
+	}
+	if fields := names(s.listVirtual("fields")); !fields["scrn_height.csv"] {
+		t.Errorf("scrn_height.csv missing in %v", fields)
+	}
+	if ev := s.listVirtual("events"); len(ev) != 1 {
+		t.Errorf("got %d events, want 1", len(ev))
+	}
+}
+
+func TestMountEventDir(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	dir := filepath.Join(wd, "baseline_year_1_arm_1.csv")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	// the files are added in the background
+	var entries []os.FileInfo
+	for i := 0; i < 100 && len(entries) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		entries, _ = ioutil.ReadDir(dir)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d files, want one for each of the three forms", len(entries))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "screener.csv")); err != nil || !csvRows(3)(data) {
+		t.Errorf("screener.csv is incomplete (%v): %q", err, data)
+	}
+}
+
+func TestMountCollection(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	dir := filepath.Join(wd, "collections", "neurocog.csv")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	var entries []os.FileInfo
+	for i := 0; i < 100 && len(entries) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		entries, _ = ioutil.ReadDir(dir)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d files, want two instruments and a field", len(entries))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "scrn_age.csv")); err != nil || !csvRows(3)(data) {
+		t.Errorf("scrn_age.csv is incomplete (%v): %q", err, data)
+	}
+}
+
+func TestMountQuery(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	// the result is written next to the query every time the query is written
+	for _, tc := range []struct {
+		query string
+		rows  int
+	}{
+		{"fields: [scrn_age]\nformat: csv\n", 3},
+		{"fields: [scrn_age]\nfilterLogic: \"[scrn_age] > 9\"\nformat: csv\n", 2},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(wd, "myquery.rcq"), []byte(tc.query), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		var data []byte
+		for i := 0; i < 100 && !csvRows(tc.rows)(data); i++ {
+			time.Sleep(10 * time.Millisecond)
+			data, _ = ioutil.ReadFile(filepath.Join(wd, "myquery.csv"))
+		}
+		if !csvRows(tc.rows)(data) {
+			t.Errorf("%q: got %q, want %d rows", tc.query, data, tc.rows)
+		}
+	}
+
+	// an invalid query fails its result
+	write := func(query string) {
+		if err := ioutil.WriteFile(filepath.Join(wd, "myquery.rcq"), []byte(query), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	write("fields: []\nformat: csv\n")
+	if _, err := ioutil.ReadFile(filepath.Join(wd, "myquery.csv")); err == nil {
+		t.Errorf("myquery.csv should fail for an invalid query")
+	}
+	if status, _ := ioutil.ReadFile(filepath.Join(wd, "myquery.csv.status")); !bytes.Contains(status, []byte("no fields")) {
+		t.Errorf("the status should have the reason: %q", status)
+	}
+	// results in another format replace the earlier one
+	write("fields: [scrn_age]\nformat: json\n")
+	if _, err := os.Stat(filepath.Join(wd, "myquery.csv")); !os.IsNotExist(err) {
+		t.Errorf("myquery.csv should be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(wd, "myquery.json")); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+	// without a format the query itself reports the failure
+	write("fields: [scrn_age]\nformat: txt\n")
+	if _, err := os.Stat(filepath.Join(wd, "myquery.json")); !os.IsNotExist(err) {
+		t.Errorf("myquery.json should be removed, got %v", err)
+	}
+	if status, _ := ioutil.ReadFile(filepath.Join(wd, "myquery.rcq.status")); !bytes.Contains(status, []byte("unknown format")) {
+		t.Errorf("the status of the query should have the reason: %q", status)
+	}
+}
+
+func TestMountVirtualTree(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	entries, err := ioutil.ReadDir(filepath.Join(wd, "instruments"))
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if n := 3 * len(utils.Extensions()); len(entries) != n {
+		t.Errorf("got %d entries in instruments/, want %d", len(entries), n)
+	}
+	if _, err := os.Stat(filepath.Join(wd, "events", "baseline_year_1_arm_1", "screener.csv")); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+	if _, err := os.Create(filepath.Join(wd, "instruments", "mine.csv")); err == nil {
+		t.Errorf("instruments/ should be read-only")
+	}
+	if err := os.Chmod(filepath.Join(wd, "instruments", "screener.csv"), 0666); err == nil {
+		t.Errorf("the mode of instruments/screener.csv should not change")
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(wd, "instruments", "screener.csv")); err != nil || !csvRows(3)(data) {
+		t.Errorf("instruments/screener.csv is incomplete (%v): %q", err, data)
+	}
+	// files can be created in the directories of the data access groups
+	if _, err := os.Create(filepath.Join(wd, "dag", "mine.csv")); err == nil {
+		t.Errorf("dag/ should be read-only")
+	}
+	f, err := os.Create(filepath.Join(wd, "dag", "site_a", "screener.csv"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+	if data, err := ioutil.ReadFile(filepath.Join(wd, "dag", "site_a", "screener.csv")); err != nil || !csvRows(2)(data) {
+		t.Errorf("dag/site_a/screener.csv is incomplete (%v): %q", err, data)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/HaukeBartsch/redcapfs/nodefsC"
+	"github.com/HaukeBartsch/redcapfs/redcap"
+)
+
+// Session is a mounted REDCap project. The file system calls into the session from many
+// goroutines, the metadata of the project is read after the file system is mounted and
+// replaced while it is mounted. Callbacks that need the metadata wait until it was read
+// for the first time.
+type Session struct {
+	client *redcap.Client
+	// root is set by mount before the file system is served
+	root nodefsC.Node
+	// collectionsFile is the YAML file with the workgroup collections
+	collectionsFile string
+
+	// mu guards participants, instruments, formEventMapping and dataAccessGroups. They
+	// are replaced as a whole, callers take the current lists with metadata() and
+	// groups().
+	mu               sync.RWMutex
+	participants     []map[string]string
+	instruments      []map[string]string
+	formEventMapping []map[string]string
+	dataAccessGroups []map[string]string
+
+	// ready is closed once the metadata was read for the first time
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// queryResults maps query files to the path of their last result, runQuery holds queryMu
+	queryMu      sync.Mutex
+	queryResults map[string]string
+
+	// refreshing is set while a refresh asked for by .refresh runs
+	refreshMu  sync.Mutex
+	refreshing bool
+}
+
+// newSession returns a session for the REDCap URL and access tokens in tokens
+func newSession(tokens map[string][]string) (*Session, error) {
+	if len(tokens["REDCapURL"]) == 0 {
+		return nil, errors.New("no REDCap URL, set one with -setREDCapURL")
+	}
+	client, err := redcap.NewClient(tokens["REDCapURL"][0], tokens["accessTokens"])
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		client:       client,
+		ready:        make(chan struct{}),
+		queryResults: make(map[string]string),
+	}, nil
+}
+
+// metadata returns the participants, the data dictionary and the event mapping of the project,
+// it waits until they were read
+func (s *Session) metadata() (ps, dict, mapping []map[string]string) {
+	<-s.ready
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.participants, s.instruments, s.formEventMapping
+}
+
+// groups returns the data access groups of the project, it waits until they were read
+func (s *Session) groups() []map[string]string {
+	<-s.ready
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dataAccessGroups
+}
+
+// loadMetadata asks REDCap for the participants, the data dictionary, the event mapping and the
+// data access groups. Lists that cannot be read are kept as they are, loadMetadata returns true
+// if any of them changed.
+func (s *Session) loadMetadata() bool {
+	// callbacks do not wait for a REDCap that cannot be reached
+	defer s.readyOnce.Do(func() { close(s.ready) })
+
+	ps, err := s.client.GetParticipantsBySite()
+	if err != nil {
+		fmt.Println("Error: could not read the list of participants", err)
+	}
+	dict, err := s.client.GetInstruments()
+	if errors.Is(err, redcap.ErrUnauthorized) {
+		fmt.Println("Error: REDCap did not accept the access token, check it with -showToken", err)
+	} else if err != nil {
+		fmt.Println("Error: could not read the data dictionary", err)
+	}
+	mapping, err := s.client.GetFormEventMapping()
+	if err != nil {
+		fmt.Println("Error: could not read the event mapping", err)
+	}
+	dags, err := s.client.GetDataAccessGroups()
+	if err != nil {
+		fmt.Println("Error: could not read the data access groups", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, v := range []struct {
+		cur *[]map[string]string
+		new []map[string]string
+	}{{&s.participants, ps}, {&s.instruments, dict}, {&s.formEventMapping, mapping}, {&s.dataAccessGroups, dags}} {
+		if v.new != nil && !reflect.DeepEqual(*v.cur, v.new) {
+			*v.cur = v.new
+			changed = true
+		}
+	}
+	return changed
+}
+
+// reload reads the metadata again and updates the project files and the read-only directories
+// if the project changed and the file system is mounted
+func (s *Session) reload() {
+	if s.loadMetadata() && s.root != nil {
+		s.writeProjectFiles()
+		nodefsC.Relist(s.root)
+	}
+}
+
+// refreshMetadata reloads the metadata every interval while the file system is mounted. Cached
+// metadata is not used, it can be kept for longer than the interval.
+func (s *Session) refreshMetadata(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.client.Cache != nil {
+			if err := s.client.Cache.Expire("metadata", "formEventMapping", "dag"); err != nil {
+				fmt.Println("Error: could not clear the cached metadata", err)
+			}
+		}
+		s.reload()
+	}
+}
+
+// refresh removes the cached REDCap responses, reads the metadata again and exports the files
+// of the read-only directories again the next time they are opened
+func (s *Session) refresh() {
+	if s.client.Cache != nil {
+		if err := s.client.Cache.Invalidate(); err != nil {
+			fmt.Println("Error: could not clear the cache", err)
+		}
+	}
+	changed := s.loadMetadata()
+	if s.root == nil {
+		return
+	}
+	if changed {
+		s.writeProjectFiles()
+	}
+	nodefsC.Relist(s.root)
+}
+
+// refreshInBackground runs refresh without blocking the file system. Refreshes asked for while
+// one is running are left out, touch creates .refresh and sets its times right after.
+func (s *Session) refreshInBackground() {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if s.refreshing {
+		return
+	}
+	s.refreshing = true
+	go func() {
+		s.refresh()
+		s.refreshMu.Lock()
+		s.refreshing = false
+		s.refreshMu.Unlock()
+	}()
+}
+
+// isRefreshing returns true while a refresh started by refreshInBackground runs
+func (s *Session) isRefreshing() bool {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	return s.refreshing
+}
+
+// writeProjectFiles adds DataDictionary.json and EventMapping.json to the mounted directory
+func (s *Session) writeProjectFiles() {
+	s.addFile("DataDictionary.json")
+	s.addFile("EventMapping.json")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionWaitsForMetadata(t *testing.T) {
+	s, srv := newTestSession(t)
+	defer srv.Close()
+
+	done := make(chan bool)
+	go func() {
+		done <- s.isInstrument("screener")
+	}()
+	select {
+	case <-done:
+		t.Fatalf("callback did not wait for the metadata")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.loadMetadata()
+	if !<-done {
+		t.Errorf("screener should be an instrument once the metadata is read")
+	}
+}
+
+func TestSessionConcurrentExports(t *testing.T) {
+	s, srv := newTestSession(t)
+	defer srv.Close()
+
+	// exports start before the metadata is read and while it is read again
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p, code := s.exportFile(name)
+			if !code.Ok() || p == nil {
+				t.Errorf("%s is not exported: %v", name, code)
+				return
+			}
+			var b bytes.Buffer
+			if n, err := p(&b); err != nil || n != 2 {
+				t.Errorf("got %d records for %s (%v), want 2", n, name, err)
+			}
+		}([]string{"screener.csv", "screener.json", "screener.jsonl"}[i%3])
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.reload()
+		}()
+	}
+	s.loadMetadata()
+	wg.Wait()
+}
+
+func TestMountConcurrentCreate(t *testing.T) {
+	s, srv := setupREDCap(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := filepath.Join(wd, fmt.Sprintf("dir%d", i))
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Errorf("Mkdir failed: %v", err)
+				return
+			}
+			f, err := os.Create(filepath.Join(dir, "screener.csv"))
+			if err != nil {
+				t.Errorf("Create failed: %v", err)
+				return
+			}
+			f.Close()
+			// like touch, the times change while the export is running
+			now := time.Now()
+			if err := os.Chtimes(filepath.Join(dir, "screener.csv"), now, now); err != nil {
+				t.Errorf("Chtimes failed: %v", err)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(dir, "screener.csv")); err != nil || !csvRows(3)(data) {
+				t.Errorf("%s/screener.csv is incomplete (%v): %q", dir, err, data)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMountStatWhileListing(t *testing.T) {
+	s, srv := newTestSession(t)
+	defer srv.Close()
+	wd, clean := setupMountTest(t, s)
+	defer clean()
+
+	// listing the root waits for the metadata, its attributes do not
+	listed := make(chan error)
+	go func() {
+		_, err := ioutil.ReadDir(wd)
+		listed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := os.Stat(wd)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Stat failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Stat waited for the listing")
+	}
+	s.loadMetadata()
+	if err := <-listed; err != nil {
+		t.Errorf("ReadDir failed: %v", err)
+	}
+	<-done
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+)
+
+// identifiers are exported by REDCap next to the record id
+var identifiers = []string{
+	"redcap_event_name",
+	"redcap_repeat_instrument",
+	"redcap_repeat_instance",
+	"redcap_data_access_group",
+}
+
+// Columns returns the column names of the exported data in the order of
+// the data dictionary: the record id (the first field of the dictionary),
+// the event, repeat and data access group columns, then the fields of each
+// instrument followed by its <form>_complete status. Checkbox columns
+// follow the order of their choices. Columns that are not described by the
+// dictionary are appended in alphabetical order.
+func Columns(what []map[string]string, dictionary []map[string]string) []string {
+	present := make(map[string]bool)
+	for _, k := range what {
+		for c := range k {
+			present[c] = true
+		}
+	}
+
+	var columns []string
+	add := func(c string) {
+		if present[c] {
+			columns = append(columns, c)
+			delete(present, c)
+		}
+	}
+	if len(dictionary) > 0 {
+		add(dictionary[0]["field_name"])
+	}
+	for _, c := range identifiers {
+		add(c)
+	}
+	form := ""
+	for _, entry := range dictionary {
+		if entry["form_name"] != form {
+			if form != "" {
+				add(form + "_complete")
+			}
+			form = entry["form_name"]
+		}
+		if entry["field_type"] == "checkbox" {
+			for _, c := range checkboxColumns(entry, present) {
+				add(c)
+			}
+			continue
+		}
+		add(entry["field_name"])
+	}
+	if form != "" {
+		add(form + "_complete")
+	}
+
+	rest := make([]string, 0, len(present))
+	for c := range present {
+		rest = append(rest, c)
+	}
+	sort.Strings(rest)
+	return append(columns, rest...)
+}
+
+// checkboxColumns returns the exported columns (field___code) of a checkbox
+// field in the order of its choices
+func checkboxColumns(entry map[string]string, present map[string]bool) []string {
+	prefix := entry["field_name"] + "___"
+	order := make(map[string]int)
+	for i, choice := range strings.Split(entry["select_choices_or_calculations"], "|") {
+		code := strings.TrimSpace(strings.SplitN(choice, ",", 2)[0])
+		order[prefix+strings.ToLower(code)] = i
+	}
+
+	var columns []string
+	for c := range present {
+		if strings.HasPrefix(c, prefix) {
+			columns = append(columns, c)
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		oi, iok := order[columns[i]]
+		oj, jok := order[columns[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok && oi != oj {
+			return oi < oj
+		}
+		return columns[i] < columns[j]
+	})
+	return columns
+}
+
+// dictionaryColumns returns the columns of an export of every field of the
+// dictionary, in the order of Columns
+func dictionaryColumns(dictionary []map[string]string) []string {
+	all := make(map[string]string)
+	for _, entry := range dictionary {
+		switch entry["field_type"] {
+		case "descriptive":
+			continue
+		case "checkbox":
+			for _, choice := range strings.Split(entry["select_choices_or_calculations"], "|") {
+				if code := strings.TrimSpace(strings.SplitN(choice, ",", 2)[0]); code != "" {
+					all[entry["field_name"]+"___"+strings.ToLower(code)] = ""
+				}
+			}
+		default:
+			all[entry["field_name"]] = ""
+		}
+		if entry["form_name"] != "" {
+			all[entry["form_name"]+"_complete"] = ""
+		}
+	}
+	return Columns([]map[string]string{all}, dictionary)
+}
+
+// ExportDictionary returns the part of the dictionary that describes an
+// export of forms and fields, an export without either has every field.
+// The record id is always kept. Fields that are exported without their
+// form lose the form name, their export has no <form>_complete column.
+func ExportDictionary(dictionary []map[string]string, forms, fields []string) []map[string]string {
+	if len(forms) == 0 && len(fields) == 0 {
+		return dictionary
+	}
+	inForms := make(map[string]bool, len(forms))
+	for _, f := range forms {
+		inForms[f] = true
+	}
+	inFields := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		inFields[f] = true
+	}
+	var ret []map[string]string
+	for i, entry := range dictionary {
+		switch {
+		case inForms[entry["form_name"]]:
+			ret = append(ret, entry)
+		case i == 0 || inFields[entry["field_name"]]:
+			single := make(map[string]string, len(entry))
+			for k, v := range entry {
+				single[k] = v
+			}
+			single["form_name"] = ""
+			ret = append(ret, single)
+		}
+	}
+	return ret
+}
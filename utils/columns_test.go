@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var records = []map[string]string{
+	{"scrn_sex": "F", "screener_complete": "2", "zz_extra": "x", "enroll_total___2": "0", "id_redcap": "S001", "redcap_data_access_group": "site_a", "enroll_total___1": "1", "redcap_event_name": "baseline_year_1_arm_1", "scrn_age": "10", "enrollment_complete": "2"},
+	{"scrn_sex": "M", "screener_complete": "0", "zz_extra": "", "enroll_total___2": "1", "id_redcap": "S002", "redcap_data_access_group": "site_b", "enroll_total___1": "0", "redcap_event_name": "baseline_year_1_arm_1", "scrn_age": "", "enrollment_complete": "0"},
+}
+
+var ordered = []string{"id_redcap", "redcap_event_name", "redcap_data_access_group", "enroll_total___1", "enroll_total___2", "enrollment_complete", "scrn_age", "scrn_sex", "screener_complete", "zz_extra"}
+
+func TestColumns(t *testing.T) {
+	dict := append([]map[string]string(nil), dictionary...)
+	dict[1] = map[string]string{"field_name": "enroll_total", "form_name": "enrollment", "field_type": "checkbox", "select_choices_or_calculations": "1, Enrolled | 2, Withdrawn"}
+	// the order is the same every time
+	for i := 0; i < 10; i++ {
+		if got := Columns(records, dict); !reflect.DeepEqual(got, ordered) {
+			t.Fatalf("got %v, want %v", got, ordered)
+		}
+	}
+}
+
+func TestDictionaryColumns(t *testing.T) {
+	dict := append([]map[string]string(nil), dictionary...)
+	dict[1] = map[string]string{"field_name": "enroll_total", "form_name": "enrollment", "field_type": "checkbox", "select_choices_or_calculations": "1, Enrolled | 2, Withdrawn"}
+	want := []string{"id_redcap", "enroll_total___1", "enroll_total___2", "enrollment_complete", "scrn_age", "demo_weight", "demo_visit_date", "cp_timestamp_v2", "scrn_sex", "screener_complete"}
+	if got := dictionaryColumns(dict); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExportDictionary(t *testing.T) {
+	for _, c := range []struct {
+		forms, fields []string
+		want          []string
+	}{
+		{nil, nil, []string{"id_redcap", "enrollment_complete", "scrn_age", "demo_weight", "demo_visit_date", "cp_timestamp_v2", "scrn_sex", "screener_complete"}},
+		{[]string{"enrollment"}, nil, []string{"id_redcap", "enrollment_complete"}},
+		{nil, []string{"scrn_age", "scrn_sex"}, []string{"id_redcap", "scrn_age", "scrn_sex"}},
+		{[]string{"enrollment"}, []string{"scrn_age"}, []string{"id_redcap", "enrollment_complete", "scrn_age"}},
+	} {
+		got := dictionaryColumns(ExportDictionary(dictionary, c.forms, c.fields))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v %v: got %v, want %v", c.forms, c.fields, got, c.want)
+		}
+	}
+}
+
+func TestWritersUseColumnOrder(t *testing.T) {
+	dict := append([]map[string]string(nil), dictionary...)
+	dict[1] = map[string]string{"field_name": "enroll_total", "form_name": "enrollment", "field_type": "checkbox", "select_choices_or_calculations": "1, Enrolled | 2, Withdrawn"}
+
+	var b bytes.Buffer
+	if err := WriteAsCsv(records, dict, &b); err != nil {
+		t.Fatalf("WriteAsCsv failed: %v", err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil || len(rows) != 3 || !reflect.DeepEqual(rows[0], ordered) {
+		t.Errorf("got header %v (%v), want %v", rows, err, ordered)
+	}
+
+	b.Reset()
+	if err := WriteAsJson(records, dict, &b); err != nil {
+		t.Fatalf("WriteAsJson failed: %v", err)
+	}
+	var dat []map[string]string
+	if err := json.Unmarshal(b.Bytes(), &dat); err != nil || !reflect.DeepEqual(dat, records) {
+		t.Fatalf("json does not round trip (%v): %s", err, b.Bytes())
+	}
+	last := -1
+	for _, c := range ordered {
+		i := strings.Index(b.String(), `"`+c+`"`)
+		if i < last {
+			t.Errorf("%s is out of order in %s", c, b.Bytes())
+		}
+		last = i
+	}
+}
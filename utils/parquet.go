@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// column describes how a REDCap field is stored in a parquet file
+type column struct {
+	tag     string
+	convert func(string) (string, error)
+}
+
+var (
+	textColumn = column{
+		tag: "type=BYTE_ARRAY, convertedtype=UTF8",
+	}
+	intColumn = column{
+		tag: "type=INT64",
+		convert: func(s string) (string, error) {
+			_, err := strconv.ParseInt(s, 10, 64)
+			return s, err
+		},
+	}
+	floatColumn = column{
+		tag: "type=DOUBLE",
+		convert: func(s string) (string, error) {
+			// number_comma_decimal uses a comma
+			s = strings.Replace(s, ",", ".", 1)
+			_, err := strconv.ParseFloat(s, 64)
+			return s, err
+		},
+	}
+	boolColumn = column{
+		tag: "type=BOOLEAN",
+		convert: func(s string) (string, error) {
+			b, err := strconv.ParseBool(s)
+			return strconv.FormatBool(b), err
+		},
+	}
+	// dates are stored as days since the epoch
+	dateColumn = column{
+		tag: "type=INT32, convertedtype=DATE",
+		convert: func(s string) (string, error) {
+			t, err := time.Parse("2006-01-02", s)
+			return strconv.FormatInt(t.Unix()/(24*60*60), 10), err
+		},
+	}
+	datetimeColumn = column{
+		tag: "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+		convert: func(s string) (string, error) {
+			var t time.Time
+			var err error
+			for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05"} {
+				if t, err = time.Parse(layout, s); err == nil {
+					break
+				}
+			}
+			return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10), err
+		},
+	}
+)
+
+// values converts the values of a column to the representation its type
+// expects, empty values stay empty
+func (c column) values(values []string) ([]string, error) {
+	if c.convert == nil {
+		return values, nil
+	}
+	converted := make([]string, len(values))
+	for i, v := range values {
+		if v == "" {
+			continue
+		}
+		var err error
+		if converted[i], err = c.convert(v); err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// columnType returns the parquet type of a field based on its entry in
+// the data dictionary
+func columnType(entry map[string]string) column {
+	switch entry["field_type"] {
+	case "calc":
+		return floatColumn
+	case "slider":
+		return intColumn
+	case "yesno", "truefalse":
+		return boolColumn
+	case "text":
+		v := entry["text_validation_type_or_show_slider_number"]
+		switch {
+		case v == "integer":
+			return intColumn
+		case strings.HasPrefix(v, "number"):
+			return floatColumn
+		case strings.HasPrefix(v, "datetime"):
+			return datetimeColumn
+		case strings.HasPrefix(v, "date"):
+			return dateColumn
+		}
+	}
+	return textColumn
+}
+
+// columnTypes returns the parquet type of each exported column. Checkbox
+// columns (field___code) are booleans, the <form>_complete status is an
+// integer and everything that is not in the dictionary is text.
+func columnTypes(columns []string, dictionary []map[string]string) []column {
+	fields := make(map[string]map[string]string, len(dictionary))
+	forms := make(map[string]bool)
+	for _, entry := range dictionary {
+		fields[entry["field_name"]] = entry
+		forms[entry["form_name"]] = true
+	}
+	types := make([]column, len(columns))
+	for i, c := range columns {
+		types[i] = textColumn
+		if entry, ok := fields[c]; ok {
+			types[i] = columnType(entry)
+		} else if l := strings.SplitN(c, "___", 2); len(l) == 2 && fields[l[0]]["field_type"] == "checkbox" {
+			types[i] = boolColumn
+		} else if forms[strings.TrimSuffix(c, "_complete")] {
+			types[i] = intColumn
+		}
+	}
+	return types
+}
+
+// WriteAsParquet exports the data as a snappy compressed parquet file. The
+// column types are derived from the data dictionary, columns with values
+// that do not fit their type are kept as text. Empty values are stored as
+// null. Without data the file has no rows and a column for every field of
+// the dictionary.
+func WriteAsParquet(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	header := Columns(what, dictionary)
+	if len(what) == 0 {
+		header = dictionaryColumns(dictionary)
+	}
+	if len(header) == 0 {
+		return errors.New("parquet: no columns, the data dictionary is empty")
+	}
+	types := columnTypes(header, dictionary)
+	md := make([]string, len(header))
+	rows := make([][]*string, len(what))
+	for i := range rows {
+		rows[i] = make([]*string, len(header))
+	}
+	for j, h := range header {
+		values := make([]string, len(what))
+		for i, k := range what {
+			values[i] = k[h]
+		}
+		if converted, err := types[j].values(values); err == nil {
+			values = converted
+		} else {
+			types[j] = textColumn
+		}
+		md[j] = fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", h, types[j].tag)
+		for i, k := range what {
+			if k[h] != "" {
+				rows[i][j] = &values[i]
+			}
+		}
+	}
+
+	w, err := writer.NewCSVWriterFromWriter(md, out, 1)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := w.WriteString(row); err != nil {
+			return err
+		}
+	}
+	return w.WriteStop()
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var dictionary = []map[string]string{
+	{"field_name": "id_redcap", "form_name": "enrollment", "field_type": "text"},
+	{"field_name": "enroll_total", "form_name": "enrollment", "field_type": "checkbox"},
+	{"field_name": "scrn_age", "form_name": "screener", "field_type": "text", "text_validation_type_or_show_slider_number": "integer"},
+	{"field_name": "demo_weight", "form_name": "screener", "field_type": "text", "text_validation_type_or_show_slider_number": "number"},
+	{"field_name": "demo_visit_date", "form_name": "screener", "field_type": "text", "text_validation_type_or_show_slider_number": "date_ymd"},
+	{"field_name": "cp_timestamp_v2", "form_name": "screener", "field_type": "text", "text_validation_type_or_show_slider_number": "datetime_ymd"},
+	{"field_name": "scrn_sex", "form_name": "screener", "field_type": "radio"},
+}
+
+func TestWriteAsParquet(t *testing.T) {
+	what := []map[string]string{
+		{"id_redcap": "S001", "redcap_event_name": "baseline_year_1_arm_1", "enroll_total___1": "1", "scrn_age": "10", "demo_weight": "35.5", "demo_visit_date": "2019-06-01", "cp_timestamp_v2": "2019-06-01 10:15", "scrn_sex": "F", "screener_complete": "2"},
+		{"id_redcap": "S002", "redcap_event_name": "baseline_year_1_arm_1", "enroll_total___1": "0", "scrn_age": "", "demo_weight": "n/a", "demo_visit_date": "", "cp_timestamp_v2": "", "scrn_sex": "1", "screener_complete": "0"},
+	}
+	var b bytes.Buffer
+	if err := WriteAsParquet(what, dictionary, &b); err != nil {
+		t.Fatalf("WriteAsParquet failed: %v", err)
+	}
+
+	f, err := buffer.NewBufferFile(b.Bytes())
+	if err != nil {
+		t.Fatalf("NewBufferFile failed: %v", err)
+	}
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		t.Fatalf("NewParquetReader failed: %v", err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != 2 {
+		t.Errorf("got %d rows, want 2", n)
+	}
+
+	types := map[string]parquet.Type{}
+	converted := map[string]parquet.ConvertedType{}
+	for _, e := range pr.Footer.Schema[1:] {
+		types[e.Name] = e.GetType()
+		if e.ConvertedType != nil {
+			converted[e.Name] = e.GetConvertedType()
+		}
+	}
+	for name, want := range map[string]parquet.Type{
+		"id_redcap":         parquet.Type_BYTE_ARRAY,
+		"redcap_event_name": parquet.Type_BYTE_ARRAY,
+		"enroll_total___1":  parquet.Type_BOOLEAN,
+		"scrn_age":          parquet.Type_INT64,
+		"demo_visit_date":   parquet.Type_INT32,
+		"cp_timestamp_v2":   parquet.Type_INT64,
+		"scrn_sex":          parquet.Type_BYTE_ARRAY,
+		"screener_complete": parquet.Type_INT64,
+		// n/a is not a number
+		"demo_weight": parquet.Type_BYTE_ARRAY,
+	} {
+		if got, ok := types[name]; !ok || got != want {
+			t.Errorf("column %s has type %v, want %v", name, got, want)
+		}
+	}
+	if converted["demo_visit_date"] != parquet.ConvertedType_DATE {
+		t.Errorf("demo_visit_date is not a date")
+	}
+	if converted["cp_timestamp_v2"] != parquet.ConvertedType_TIMESTAMP_MILLIS {
+		t.Errorf("cp_timestamp_v2 is not a timestamp")
+	}
+}
+
+func TestWriteAsParquetEmpty(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteAsParquet(nil, ExportDictionary(dictionary, []string{"screener"}, nil), &b); err != nil {
+		t.Fatalf("WriteAsParquet failed: %v", err)
+	}
+	f, err := buffer.NewBufferFile(b.Bytes())
+	if err != nil {
+		t.Fatalf("NewBufferFile failed: %v", err)
+	}
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		t.Fatalf("an export without data is not a parquet file: %v", err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != 0 {
+		t.Errorf("got %d rows, want none", n)
+	}
+	var names []string
+	types := map[string]parquet.Type{}
+	for _, e := range pr.Footer.Schema[1:] {
+		names = append(names, e.Name)
+		types[e.Name] = e.GetType()
+	}
+	want := []string{"id_redcap", "scrn_age", "demo_weight", "demo_visit_date", "cp_timestamp_v2", "scrn_sex", "screener_complete"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got columns %v, want %v", names, want)
+	}
+	for name, want := range map[string]parquet.Type{
+		"id_redcap":         parquet.Type_BYTE_ARRAY,
+		"scrn_age":          parquet.Type_INT64,
+		"screener_complete": parquet.Type_INT64,
+	} {
+		if got, ok := types[name]; !ok || got != want {
+			t.Errorf("column %s has type %v, want %v", name, got, want)
+		}
+	}
+}
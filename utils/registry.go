@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// Writer encodes exported records in one file format. The data dictionary
+// of the project describes the exported fields.
+type Writer interface {
+	Write(what []map[string]string, dictionary []map[string]string, out io.Writer) error
+}
+
+// WriterFunc lets an ordinary function be used as a Writer
+type WriterFunc func(what []map[string]string, dictionary []map[string]string, out io.Writer) error
+
+func (f WriterFunc) Write(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	return f(what, dictionary, out)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Writer)
+)
+
+// RegisterWriter makes a file format available for the extension ext
+// (including the dot). A later registration replaces an earlier one.
+func RegisterWriter(ext string, w Writer) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[ext] = w
+}
+
+// WriterFor returns the writer registered for the extension ext
+func WriterFor(ext string) (Writer, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	w, ok := registry[ext]
+	return w, ok
+}
+
+// Extensions returns the registered extensions in sorted order
+func Extensions() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	exts := make([]string, 0, len(registry))
+	for ext := range registry {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+func init() {
+	RegisterWriter(".csv", Csv{})
+	RegisterWriter(".json", Json{})
+	RegisterWriter(".jsonl", JsonLines{})
+	RegisterWriter(".xlsx", WriterFunc(WriteAsExcel))
+	RegisterWriter(".parquet", WriterFunc(WriteAsParquet))
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"io"
+	"testing"
+)
+
+func TestRegisterWriter(t *testing.T) {
+	for _, ext := range []string{".csv", ".json", ".xlsx", ".parquet"} {
+		if _, ok := WriterFor(ext); !ok {
+			t.Errorf("no writer for %s", ext)
+		}
+	}
+	if _, ok := WriterFor(".txt"); ok {
+		t.Errorf(".txt should not have a writer")
+	}
+
+	called := false
+	RegisterWriter(".test", WriterFunc(func(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+		called = true
+		return nil
+	}))
+	defer func() {
+		registryMu.Lock()
+		delete(registry, ".test")
+		registryMu.Unlock()
+	}()
+	w, ok := WriterFor(".test")
+	if !ok {
+		t.Fatal("registered writer not found")
+	}
+	w.Write(nil, nil, nil)
+	if !called {
+		t.Errorf("registered writer was not used")
+	}
+	found := false
+	for _, ext := range Extensions() {
+		found = found || ext == ".test"
+	}
+	if !found {
+		t.Errorf(".test missing in %v", Extensions())
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"io"
+)
+
+// RecordWriter encodes one record at a time
+type RecordWriter interface {
+	WriteRecord(record map[string]string) error
+	// Close completes the output
+	Close() error
+}
+
+// Streamer is implemented by writers that do not need all records at once.
+// The columns of the output are known before the first record is written.
+type Streamer interface {
+	NewRecordWriter(out io.Writer, columns []string) (RecordWriter, error)
+}
+
+// Encoder writes records in the format of a Writer as they arrive. Writers
+// that implement Streamer only see the current record, all other writers
+// get the collected records when the Encoder is closed.
+type Encoder struct {
+	w          Writer
+	dictionary []map[string]string
+	out        io.Writer
+
+	rw      RecordWriter
+	buf     []map[string]string
+	records int
+}
+
+// NewEncoder returns an encoder that writes to out in the format of w
+func NewEncoder(w Writer, dictionary []map[string]string, out io.Writer) *Encoder {
+	return &Encoder{
+		w:          w,
+		dictionary: dictionary,
+		out:        out,
+	}
+}
+
+// Encode writes a single record, the columns of the output are taken from
+// the first record
+func (e *Encoder) Encode(record map[string]string) error {
+	s, ok := e.w.(Streamer)
+	if !ok {
+		e.buf = append(e.buf, record)
+		e.records++
+		return nil
+	}
+	if e.rw == nil {
+		rw, err := s.NewRecordWriter(e.out, Columns([]map[string]string{record}, e.dictionary))
+		if err != nil {
+			return err
+		}
+		e.rw = rw
+	}
+	if err := e.rw.WriteRecord(record); err != nil {
+		return err
+	}
+	e.records++
+	return nil
+}
+
+// Close writes what is left, the output is complete afterwards
+func (e *Encoder) Close() error {
+	if e.rw != nil {
+		return e.rw.Close()
+	}
+	return e.w.Write(e.buf, e.dictionary, e.out)
+}
+
+// Records returns the number of records encoded so far
+func (e *Encoder) Records() int {
+	return e.records
+}
+
+// writeAll writes a list of records with a streaming writer
+func writeAll(s Streamer, what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	rw, err := s.NewRecordWriter(out, Columns(what, dictionary))
+	if err != nil {
+		return err
+	}
+	for _, k := range what {
+		if err := rw.WriteRecord(k); err != nil {
+			return err
+		}
+	}
+	return rw.Close()
+}
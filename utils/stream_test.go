@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncoderStreams(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(Csv{}, dictionary, &b)
+	for i, k := range records {
+		if err := enc.Encode(k); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		// the header and every record are written right away
+		if n := strings.Count(b.String(), "\n"); n > i+2 {
+			t.Errorf("got %d lines after %d records", n, i+1)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if enc.Records() != len(records) || strings.Count(b.String(), "\n") != len(records)+1 {
+		t.Errorf("got %d records: %q", enc.Records(), b.String())
+	}
+}
+
+func TestEncoderCollects(t *testing.T) {
+	var got []map[string]string
+	w := WriterFunc(func(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+		got = what
+		return nil
+	})
+	enc := NewEncoder(w, dictionary, nil)
+	for _, k := range records {
+		enc.Encode(k)
+	}
+	if got != nil {
+		t.Errorf("writers that cannot stream should get all records at once")
+	}
+	if err := enc.Close(); err != nil || len(got) != len(records) {
+		t.Errorf("got %d records (%v), want %d", len(got), err, len(records))
+	}
+}
+
+func TestJsonLines(t *testing.T) {
+	var b bytes.Buffer
+	if err := (JsonLines{}).Write(records, dictionary, &b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(records), b.String())
+	}
+	for i, l := range lines {
+		var v map[string]string
+		if err := json.Unmarshal([]byte(l), &v); err != nil || v["id_redcap"] != records[i]["id_redcap"] {
+			t.Errorf("line %d is %q (%v)", i, l, err)
+		}
+	}
+
+	// an empty list is still valid json
+	b.Reset()
+	if err := WriteAsJson(nil, dictionary, &b); err != nil || b.String() != "[]" {
+		t.Errorf("got %q (%v) for no records", b.String(), err)
+	}
+}
@@ -1,127 +1,181 @@
 package utils
 
 import (
+	"bufio"
 	"encoding/csv"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"sort"
+	"io"
 
 	"github.com/tealeg/xlsx"
 )
 
-// WriteAsCsv exports the data as a csv file to the file system
-func WriteAsCsv(what []map[string]string, path string) {
-	// check if we got something back for writing
-	if len(what) < 2 {
-		vals, err := json.Marshal(what)
-		if err != nil {
-			fmt.Println("Error: could not convert mapping into json for print")
-			return
-		}
-		fmt.Println("Error: we expect at least a header and some values from this call but got ", string(vals))
-		return
+// Csv streams comma separated values
+type Csv struct{}
+
+func (Csv) Write(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	return WriteAsCsv(what, dictionary, out)
+}
+
+func (Csv) NewRecordWriter(out io.Writer, columns []string) (RecordWriter, error) {
+	w := csv.NewWriter(out)
+	if err := w.Write(columns); err != nil {
+		return nil, err
 	}
+	return &csvRecordWriter{
+		w:       w,
+		columns: columns,
+		values:  make([]string, len(columns)),
+	}, nil
+}
 
-	file, err := os.Create(path)
-	if err != nil {
-		fmt.Println("Cannot create file", err)
-		return
+type csvRecordWriter struct {
+	w       *csv.Writer
+	columns []string
+	values  []string
+}
+
+func (r *csvRecordWriter) WriteRecord(record map[string]string) error {
+	for i, h := range r.columns {
+		r.values[i] = record[h]
 	}
-	defer file.Close()
+	return r.w.Write(r.values)
+}
 
-	w := csv.NewWriter(file)
+func (r *csvRecordWriter) Close() error {
+	r.w.Flush()
+	return r.w.Error()
+}
 
-	header := make([]string, len(what[0]))
-	i := 0
-	for k := range what[0] {
-		header[i] = k
-		i++
+// WriteAsCsv exports the data as comma separated values
+func WriteAsCsv(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	// nothing to write, we cannot even guess the header
+	if len(what) == 0 {
+		return nil
 	}
+	return writeAll(Csv{}, what, dictionary, out)
+}
+
+// Json streams a json list of records
+type Json struct{}
+
+func (Json) Write(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	return WriteAsJson(what, dictionary, out)
+}
 
-	if err := w.Write(header); err != nil {
-		//write failed do something
-		fmt.Println("Error: could not write header to file")
+func (Json) NewRecordWriter(out io.Writer, columns []string) (RecordWriter, error) {
+	w := bufio.NewWriter(out)
+	if _, err := w.WriteString("["); err != nil {
+		return nil, err
 	}
-	keys := make([]int, len(what))
-	i = 0
-	for k := range what {
-		keys[i] = k
-		i++
+	return &jsonRecordWriter{
+		w:       w,
+		columns: columns,
+		indent:  true,
+	}, nil
+}
+
+// JsonLines streams one json object per line
+type JsonLines struct{}
+
+func (JsonLines) Write(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	return writeAll(JsonLines{}, what, dictionary, out)
+}
+
+func (JsonLines) NewRecordWriter(out io.Writer, columns []string) (RecordWriter, error) {
+	return &jsonRecordWriter{
+		w:       bufio.NewWriter(out),
+		columns: columns,
+	}, nil
+}
+
+// jsonRecordWriter writes the keys of each record in the order of the columns,
+// either as the indented elements of a list or one record per line
+type jsonRecordWriter struct {
+	w       *bufio.Writer
+	columns []string
+	indent  bool
+	records int
+}
+
+func (r *jsonRecordWriter) WriteRecord(record map[string]string) error {
+	sep, open, end := "", "{", "}\n"
+	if r.indent {
+		sep, open, end = "\n        ", "\n    {", "\n    }"
+		if r.records > 0 {
+			open = "," + open
+		}
 	}
-	sort.Ints(keys)
-
-	for _, kk := range keys {
-		k := what[kk]
-		values := make([]string, len(what[0]))
-		i = 0
-		for _ = range header {
-			values[i] = k[header[i]]
-			i++
+	r.records++
+
+	r.w.WriteString(open)
+	first := true
+	for _, h := range r.columns {
+		v, ok := record[h]
+		if !ok {
+			continue
+		}
+		if !first {
+			r.w.WriteString(",")
+		}
+		first = false
+		key, err := json.Marshal(h)
+		if err != nil {
+			return err
 		}
-		if err := w.Write(values); err != nil {
-			//write failed do something
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		r.w.WriteString(sep)
+		r.w.Write(key)
+		r.w.WriteString(":")
+		if r.indent {
+			r.w.WriteString(" ")
 		}
+		r.w.Write(value)
 	}
-	defer w.Flush()
+	_, err := r.w.WriteString(end)
+	return err
 }
 
-// WriteAsJson exports the data as a json file to the file system
-func WriteAsJson(what []map[string]string, path string) {
-	b, err := json.MarshalIndent(what, "", "    ")
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = ioutil.WriteFile(path, b, 0644)
-	if err != nil {
-		fmt.Println(err)
+func (r *jsonRecordWriter) Close() error {
+	if r.indent {
+		if r.records > 0 {
+			r.w.WriteString("\n")
+		}
+		r.w.WriteString("]")
 	}
+	return r.w.Flush()
+}
+
+// WriteAsJson exports the data as json, the keys of each record are in
+// the order of the data dictionary
+func WriteAsJson(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	return writeAll(Json{}, what, dictionary, out)
 }
 
 // WriteAsExcel export the data as an excel file
-func WriteAsExcel(what []map[string]string, path string) {
-	var file *xlsx.File
-	var sheet *xlsx.Sheet
-	var row *xlsx.Row
-	var cell *xlsx.Cell
-	var err error
-
-	file = xlsx.NewFile()
-	sheet, err = file.AddSheet("ABCD")
+func WriteAsExcel(what []map[string]string, dictionary []map[string]string, out io.Writer) error {
+	file := xlsx.NewFile()
+	sheet, err := file.AddSheet("ABCD")
 	if err != nil {
-		fmt.Printf(err.Error())
-	}
-	//row = sheet.AddRow()
-	//cell = row.AddCell()
-	//cell.Value = "I am a cell!"
-
-	if len(what) == 0 {
-		fmt.Printf("Error: what does not contain an array %s, cannot save this value to %s", what, path)
-		return
+		return err
 	}
 
-	header := make([]string, len(what[0]))
-	row = sheet.AddRow()
-	i := 0
-	for k := range what[0] {
-		header[i] = k
-		i++
-		cell = row.AddCell()
-		cell.Value = k
-	}
-
-	for _, k := range what {
-		row = sheet.AddRow()
-		for _, k2 := range header {
-			cell = row.AddCell()
-			cell.Value = k[k2]
+	if len(what) > 0 {
+		header := Columns(what, dictionary)
+		row := sheet.AddRow()
+		for _, k := range header {
+			cell := row.AddCell()
+			cell.Value = k
+		}
+		for _, k := range what {
+			row = sheet.AddRow()
+			for _, k2 := range header {
+				cell := row.AddCell()
+				cell.Value = k[k2]
+			}
 		}
 	}
-
-	err = file.Save(path)
-	if err != nil {
-		fmt.Printf(err.Error())
-	}
+	return file.Write(out)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/HaukeBartsch/redcapfs/utils"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// virtualDirs are the read-only directories that list what can be exported
+var virtualDirs = []string{"instruments", "events", "fields"}
+
+// dagDir has a directory for every data access group, exports created in them only contain
+// the records of the group
+const dagDir = "dag"
+
+// isVirtual returns true if path is inside one of the read-only directories
+func isVirtual(path string) bool {
+	for _, d := range virtualDirs {
+		if path == d || strings.HasPrefix(path, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func dirEntry(name string) fuse.DirEntry {
+	return fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR}
+}
+
+func fileEntry(name string) fuse.DirEntry {
+	return fuse.DirEntry{Name: name, Mode: fuse.S_IFREG}
+}
+
+// formNames returns the instruments in the order of the data dictionary
+func formNames(dict []map[string]string) []string {
+	var forms []string
+	seen := make(map[string]bool)
+	for _, entry := range dict {
+		if f := entry["form_name"]; f != "" && !seen[f] {
+			seen[f] = true
+			forms = append(forms, f)
+		}
+	}
+	return forms
+}
+
+// listVirtual provides the content of the read-only directories:
+//
+//	instruments/<form_name>.<ext> for every registered format
+//	events/<unique_event_name>/<form>.csv
+//	fields/<field_name>.csv
+//	dag/<unique_group_name>/
+//	collections/ if there are collections
+func (s *Session) listVirtual(path string) []fuse.DirEntry {
+	var entries []fuse.DirEntry
+	_, dict, mapping := s.metadata()
+	l := strings.Split(path, "/")
+	switch {
+	case path == "":
+		for _, d := range virtualDirs {
+			entries = append(entries, dirEntry(d))
+		}
+		entries = append(entries, dirEntry(dagDir))
+		if len(s.collections()) > 0 {
+			// collections are exported by creating their directory
+			entries = append(entries, fuse.DirEntry{Name: collectionsDir, Mode: fuse.S_IFDIR | 0755})
+		}
+	case path == dagDir:
+		for _, g := range s.groups() {
+			// files can be created in the directories of the groups
+			entries = append(entries, fuse.DirEntry{Name: g["unique_group_name"], Mode: fuse.S_IFDIR | 0755})
+		}
+	case path == "instruments":
+		for _, form := range formNames(dict) {
+			for _, ext := range utils.Extensions() {
+				entries = append(entries, fileEntry(form+ext))
+			}
+		}
+	case path == "events":
+		seen := make(map[string]bool)
+		for _, v := range mapping {
+			if ev := v["unique_event_name"]; !seen[ev] {
+				seen[ev] = true
+				entries = append(entries, dirEntry(ev))
+			}
+		}
+	case len(l) == 2 && l[0] == "events":
+		for _, v := range mapping {
+			if v["unique_event_name"] == l[1] {
+				entries = append(entries, fileEntry(v["form"]+".csv"))
+			}
+		}
+	case path == "fields":
+		for _, entry := range dict {
+			if entry["field_type"] == "descriptive" {
+				continue
+			}
+			entries = append(entries, fileEntry(entry["field_name"]+".csv"))
+		}
+	}
+	return entries
+}